@@ -0,0 +1,28 @@
+// Package derivatives caches rendered images.
+package derivatives
+
+import (
+	"image"
+)
+
+// Derivative is a rendered image.
+type Derivative struct {
+	ContentType string
+
+	// FullSize is the size of the full image that the derivative was
+	// rendered from.
+	FullSize image.Point
+
+	Body []byte
+}
+
+// Cache is a store of derivatives. Implementations are safe for concurrent
+// use.
+type Cache interface {
+	// Get returns the derivative stored under a key, if any. It must not
+	// be modified.
+	Get(key string) (*Derivative, bool)
+
+	// Put stores a derivative under a key, if there is room for it.
+	Put(key string, d *Derivative)
+}
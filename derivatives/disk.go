@@ -0,0 +1,276 @@
+package derivatives
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type diskCache struct {
+	dir      string
+	maxBytes int64
+
+	mu      sync.Mutex
+	bytes   int64
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type diskEntry struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+// diskHeader is the first line of a stored derivative, followed by its
+// body.
+type diskHeader struct {
+	Key         string `json:"key"`
+	ContentType string `json:"contentType"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+}
+
+// NewDiskCache returns a cache that keeps up to maxBytes of derivatives in
+// files under a directory, evicting the least recently used ones first.
+// Files are spread over 256 subdirectories, so that no directory gets too
+// large. Derivatives stored by an earlier process are kept.
+func NewDiskCache(dir string, maxBytes int64) (Cache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	c := &diskCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  map[string]*list.Element{},
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Get implements interface Cache.
+func (c *diskCache) Get(key string) (*Derivative, bool) {
+	name := fileName(key)
+
+	c.mu.Lock()
+	e, ok := c.entries[name]
+	if ok {
+		c.lru.MoveToFront(e)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	d, err := c.read(name, key)
+	if err != nil {
+		log.Printf("Derivative cache: Unable to read %s: %s", c.path(name), err)
+		c.remove(name)
+		return nil, false
+	}
+	// Keep the order of use for the next process
+	now := time.Now()
+	os.Chtimes(c.path(name), now, now)
+	return d, true
+}
+
+// Put implements interface Cache.
+func (c *diskCache) Put(key string, d *Derivative) {
+	header, err := json.Marshal(diskHeader{
+		Key:         key,
+		ContentType: d.ContentType,
+		Width:       d.FullSize.X,
+		Height:      d.FullSize.Y,
+	})
+	if err != nil {
+		log.Printf("Derivative cache: Unable to store %q: %s", key, err)
+		return
+	}
+	size := int64(len(header) + 1 + len(d.Body))
+	if size > c.maxBytes {
+		return
+	}
+
+	name := fileName(key)
+	path := c.path(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		log.Printf("Derivative cache: Unable to store %q: %s", key, err)
+		return
+	}
+	data := make([]byte, 0, size)
+	data = append(append(append(data, header...), '\n'), d.Body...)
+	if err := writeFileAtomically(path, data); err != nil {
+		log.Printf("Derivative cache: Unable to store %q: %s", key, err)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.add(&diskEntry{name: name, size: size}, true)
+}
+
+// add inserts an entry as the most or least recently used, replacing any
+// with the same name, and evicts the least recently used entries while the
+// cache is too large. The caller must hold c.mu.
+func (c *diskCache) add(entry *diskEntry, front bool) {
+	if e, ok := c.entries[entry.name]; ok {
+		c.bytes -= e.Value.(*diskEntry).size
+		c.lru.Remove(e)
+	}
+	if front {
+		c.entries[entry.name] = c.lru.PushFront(entry)
+	} else {
+		c.entries[entry.name] = c.lru.PushBack(entry)
+	}
+	c.bytes += entry.size
+
+	for c.bytes > c.maxBytes {
+		c.removeLocked(c.lru.Back().Value.(*diskEntry).name)
+	}
+}
+
+func (c *diskCache) remove(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(name)
+}
+
+// removeLocked deletes an entry. The caller must hold c.mu.
+func (c *diskCache) removeLocked(name string) {
+	if e, ok := c.entries[name]; ok {
+		c.bytes -= e.Value.(*diskEntry).size
+		c.lru.Remove(e)
+		delete(c.entries, name)
+	}
+	os.Remove(c.path(name))
+}
+
+func (c *diskCache) read(name, key string) (*Derivative, error) {
+	data, err := ioutil.ReadFile(c.path(name))
+	if err != nil {
+		return nil, err
+	}
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		return nil, errors.New("no header")
+	}
+	var header diskHeader
+	if err := json.Unmarshal(data[:i], &header); err != nil {
+		return nil, fmt.Errorf("invalid header: %s", err)
+	}
+	if header.Key != key {
+		return nil, fmt.Errorf("stored under key %q", header.Key)
+	}
+	return &Derivative{
+		ContentType: header.ContentType,
+		FullSize:    image.Pt(header.Width, header.Height),
+		Body:        data[i+1:],
+	}, nil
+}
+
+// load builds the index from the files on disk, most recently used first.
+// Files left behind by interrupted writes are removed.
+func (c *diskCache) load() error {
+	paths, err := filepath.Glob(filepath.Join(c.dir, "??", "*"))
+	if err != nil {
+		return err
+	}
+
+	var entries []*diskEntry
+	for _, path := range paths {
+		name := filepath.Base(path)
+		if strings.HasPrefix(name, ".tmp-") {
+			os.Remove(path)
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || !validHeader(path) || c.path(name) != path {
+			log.Printf("Derivative cache: Ignoring invalid file %s", path)
+			continue
+		}
+		entries = append(entries, &diskEntry{name: name, size: info.Size(), modTime: info.ModTime()})
+	}
+	sort.Sort(byModTime(entries))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, entry := range entries {
+		c.add(entry, false)
+	}
+	return nil
+}
+
+func (c *diskCache) path(name string) string {
+	return filepath.Join(c.dir, name[:2], name)
+}
+
+// validHeader returns whether a file starts with a header whose key is
+// the one that the file is named after.
+func validHeader(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil {
+		return false
+	}
+	var header diskHeader
+	return json.Unmarshal(line, &header) == nil && fileName(header.Key) == filepath.Base(path)
+}
+
+func fileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// writeFileAtomically writes a file through a temporary file, so that
+// readers never see a partial file.
+func writeFileAtomically(path string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("unable to rename %s: %s", f.Name(), err)
+	}
+	return nil
+}
+
+// byModTime sorts entries by descending modification time.
+type byModTime []*diskEntry
+
+func (e byModTime) Len() int           { return len(e) }
+func (e byModTime) Less(i, j int) bool { return e[i].modTime.After(e[j].modTime) }
+func (e byModTime) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
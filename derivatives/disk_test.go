@@ -0,0 +1,61 @@
+package derivatives_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/t11e/picaxe/derivatives"
+)
+
+func TestDiskCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "picaxe")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Each entry takes its body plus a 63-byte header
+	cache, err := derivatives.NewDiskCache(dir, 200)
+	require.NoError(t, err)
+	assertMiss(t, cache, "a")
+
+	cache.Put("a", newDerivative("aaaa"))
+	cache.Put("b", newDerivative("bbbb"))
+	assertHit(t, cache, "a", "aaaa")
+	assertHit(t, cache, "b", "bbbb")
+
+	files, err := filepath.Glob(filepath.Join(dir, "*", "*"))
+	require.NoError(t, err)
+	assert.Len(t, files, 2)
+
+	// Evicts the least recently used
+	assertHit(t, cache, "a", "aaaa")
+	cache.Put("c", newDerivative("cccc"))
+	assertHit(t, cache, "a", "aaaa")
+	assertMiss(t, cache, "b")
+	assertHit(t, cache, "c", "cccc")
+
+	// Too large to store at all
+	cache.Put("d", newDerivative(string(make([]byte, 200))))
+	assertMiss(t, cache, "d")
+
+	// Entries survive restarts
+	cache, err = derivatives.NewDiskCache(dir, 200)
+	require.NoError(t, err)
+	assertHit(t, cache, "a", "aaaa")
+	assertHit(t, cache, "c", "cccc")
+
+	// Damaged files are misses
+	files, err = filepath.Glob(filepath.Join(dir, "*", "*"))
+	require.NoError(t, err)
+	for _, file := range files {
+		require.NoError(t, ioutil.WriteFile(file, []byte("garbage"), 0644))
+	}
+	assertMiss(t, cache, "a")
+	cache, err = derivatives.NewDiskCache(dir, 200)
+	require.NoError(t, err)
+	assertMiss(t, cache, "c")
+}
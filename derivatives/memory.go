@@ -0,0 +1,67 @@
+package derivatives
+
+import (
+	"container/list"
+	"sync"
+)
+
+type memoryCache struct {
+	maxBytes int64
+
+	mu      sync.Mutex
+	bytes   int64
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type memoryEntry struct {
+	key string
+	d   *Derivative
+}
+
+// NewMemoryCache returns a cache that keeps up to maxBytes of derivatives
+// in memory, evicting the least recently used ones first.
+func NewMemoryCache(maxBytes int64) Cache {
+	return &memoryCache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  map[string]*list.Element{},
+	}
+}
+
+// Get implements interface Cache.
+func (c *memoryCache) Get(key string) (*Derivative, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(e)
+		return e.Value.(*memoryEntry).d, true
+	}
+	return nil, false
+}
+
+// Put implements interface Cache.
+func (c *memoryCache) Put(key string, d *Derivative) {
+	size := int64(len(d.Body))
+	if size > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+	for c.bytes+size > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+	c.entries[key] = c.lru.PushFront(&memoryEntry{key: key, d: d})
+	c.bytes += size
+}
+
+// remove deletes an entry. The caller must hold c.mu.
+func (c *memoryCache) remove(e *list.Element) {
+	entry := c.lru.Remove(e).(*memoryEntry)
+	delete(c.entries, entry.key)
+	c.bytes -= int64(len(entry.d.Body))
+}
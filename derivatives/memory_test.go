@@ -0,0 +1,56 @@
+package derivatives_test
+
+import (
+	"image"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/t11e/picaxe/derivatives"
+)
+
+func newDerivative(body string) *derivatives.Derivative {
+	return &derivatives.Derivative{
+		ContentType: "image/png",
+		FullSize:    image.Pt(640, 480),
+		Body:        []byte(body),
+	}
+}
+
+func assertHit(t *testing.T, cache derivatives.Cache, key, body string) {
+	d, ok := cache.Get(key)
+	if assert.True(t, ok, key) {
+		assert.Equal(t, newDerivative(body), d, key)
+	}
+}
+
+func assertMiss(t *testing.T, cache derivatives.Cache, key string) {
+	_, ok := cache.Get(key)
+	assert.False(t, ok, key)
+}
+
+func TestMemoryCache(t *testing.T) {
+	cache := derivatives.NewMemoryCache(10)
+	assertMiss(t, cache, "a")
+
+	cache.Put("a", newDerivative("aaaa"))
+	cache.Put("b", newDerivative("bbbb"))
+	assertHit(t, cache, "a", "aaaa")
+	assertHit(t, cache, "b", "bbbb")
+
+	// Evicts the least recently used
+	assertHit(t, cache, "a", "aaaa")
+	cache.Put("c", newDerivative("cccc"))
+	assertHit(t, cache, "a", "aaaa")
+	assertMiss(t, cache, "b")
+	assertHit(t, cache, "c", "cccc")
+
+	// Replaces
+	cache.Put("c", newDerivative("cc"))
+	assertHit(t, cache, "c", "cc")
+
+	// Too large to store at all
+	cache.Put("d", newDerivative("ddddddddddd"))
+	assertMiss(t, cache, "d")
+	assertHit(t, cache, "a", "aaaa")
+}
@@ -0,0 +1,54 @@
+package iiif
+
+import (
+	"image"
+
+	"github.com/t11e/picaxe/imageops"
+)
+
+// Canonical returns the canonical form of the request, for a full image of
+// the given size, as described in
+// http://iiif.io/api/image/2.1/#canonical-uri-syntax and
+// http://iiif.io/api/image/3.0/#47-canonical-uri-syntax.
+//
+// Regions are resolved to pixels, and sizes to "w," (2.1) or "w,h" (3.0),
+// unless they are the full image.
+func (r Request) Canonical(version APIVersion, full image.Point) (Request, error) {
+	bounds := image.Rectangle{Max: full}
+	rect := r.Region.Rectangle(full)
+
+	dims, err := r.Size.CalculateDimensions(rect.Size(), maxScaleSize)
+	if err != nil {
+		return Request{}, err
+	}
+
+	canonical := r
+	if rect == bounds {
+		canonical.Region = Region{Kind: RegionKindFull}
+	} else {
+		canonical.Region = Region{Kind: RegionKindAbsolute, Absolute: &rect}
+	}
+
+	switch version {
+	case APIVersion2:
+		if dims == rect.Size() {
+			canonical.Size = Size{Kind: SizeKindFull}
+		} else if w := dims.X; imageops.FitDimensions(rect.Size(), &w, nil) == dims {
+			canonical.Size = Size{Kind: SizeKindAbsolute, AbsWidth: &dims.X}
+		} else {
+			canonical.Size = Size{Kind: SizeKindAbsolute, AbsWidth: &dims.X, AbsHeight: &dims.Y}
+		}
+	case APIVersion3:
+		upscaling := UpscalingForbidden
+		if dims.X > rect.Dx() || dims.Y > rect.Dy() {
+			upscaling = UpscalingRequested
+		}
+		if dims == rect.Size() {
+			canonical.Size = Size{Kind: SizeKindMax, Upscaling: upscaling}
+		} else {
+			canonical.Size = Size{Kind: SizeKindAbsolute, AbsWidth: &dims.X, AbsHeight: &dims.Y,
+				Upscaling: upscaling}
+		}
+	}
+	return canonical, nil
+}
@@ -0,0 +1,46 @@
+package iiif_test
+
+import (
+	"image"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/t11e/picaxe/iiif"
+)
+
+func TestRequest_Canonical(t *testing.T) {
+	full := image.Pt(640, 480)
+
+	for _, test := range []struct {
+		version  iiif.APIVersion
+		spec     string
+		expected string
+	}{
+		{iiif.APIVersion2, "foo/full/full/0/default.png", "foo/full/full/0/default.png"},
+		{iiif.APIVersion2, "foo/full/max/0/default.png", "foo/full/full/0/default.png"},
+		{iiif.APIVersion2, "foo/0,0,640,480/full/0/default.png", "foo/full/full/0/default.png"},
+		{iiif.APIVersion2, "foo/full/320,/0/default.png", "foo/full/320,/0/default.png"},
+		{iiif.APIVersion2, "foo/full/,240/0/default.png", "foo/full/320,/0/default.png"},
+		{iiif.APIVersion2, "foo/full/pct:50/0/default.png", "foo/full/320,/0/default.png"},
+		{iiif.APIVersion2, "foo/full/!320,320/0/default.png", "foo/full/320,/0/default.png"},
+		{iiif.APIVersion2, "foo/full/320,320/0/default.png", "foo/full/320,320/0/default.png"},
+		{iiif.APIVersion2, "foo/pct:50,50,50,50/full/0/default.png", "foo/320,240,320,240/full/0/default.png"},
+		{iiif.APIVersion2, "foo/600,400,100,100/full/0/default.png", "foo/600,400,40,80/full/0/default.png"},
+		{iiif.APIVersion2, "foo/square/full/0/default.png", "foo/80,0,480,480/full/0/default.png"},
+		{iiif.APIVersion2, "foo/full/full/!90/color.png", "foo/full/full/!90/default.png"},
+		{iiif.APIVersion3, "foo/full/max/0/default.png", "foo/full/max/0/default.png"},
+		{iiif.APIVersion3, "foo/full/320,/0/default.png", "foo/full/320,240/0/default.png"},
+		{iiif.APIVersion3, "foo/full/^pct:200/0/default.png", "foo/full/^1280,960/0/default.png"},
+		{iiif.APIVersion3, "foo/square/max/0/default.png", "foo/80,0,480,480/max/0/default.png"},
+	} {
+		t.Run(test.spec, func(t *testing.T) {
+			req, err := iiif.ParseVersionedSpec(test.version, test.spec)
+			require.NoError(t, err)
+			canonical, err := req.Canonical(test.version, full)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, canonical.Path(test.version))
+		})
+	}
+}
@@ -0,0 +1,236 @@
+package iiif
+
+import (
+	"fmt"
+	"image"
+	"net/url"
+	"regexp"
+)
+
+const (
+	// ContextURI is the JSON-LD context of image information documents.
+	ContextURI = "http://iiif.io/api/image/2/context.json"
+
+	// ProtocolURI identifies the IIIF Image API protocol.
+	ProtocolURI = "http://iiif.io/api/image"
+
+	// ComplianceLevelURI is the compliance level we claim to support.
+	ComplianceLevelURI = "http://iiif.io/api/image/2/level1.json"
+
+	// ContextURI3 is the JSON-LD context of Image API 3.0 documents.
+	ContextURI3 = "http://iiif.io/api/image/3/context.json"
+
+	// ComplianceLevel3 is the Image API 3.0 compliance level we claim to
+	// support.
+	ComplianceLevel3 = "level1"
+
+	// ComplianceLevelURI3 is the URI of ComplianceLevel3.
+	ComplianceLevelURI3 = "http://iiif.io/api/image/3/level1.json"
+)
+
+// ImageInfo is an image information document, as described in
+// http://iiif.io/api/image/2.1/#image-information.
+type ImageInfo struct {
+	Context  string        `json:"@context"`
+	ID       string        `json:"@id"`
+	Protocol string        `json:"protocol"`
+	Width    int           `json:"width"`
+	Height   int           `json:"height"`
+	Sizes    []SizeInfo    `json:"sizes,omitempty"`
+	Tiles    []TileInfo    `json:"tiles,omitempty"`
+	Profile  []interface{} `json:"profile"`
+}
+
+// SizeInfo is a preferred size of the full image.
+type SizeInfo struct {
+	Type   string `json:"type,omitempty"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// TileInfo describes a set of tiles of the image.
+type TileInfo struct {
+	Type         string `json:"type,omitempty"`
+	Width        int    `json:"width"`
+	ScaleFactors []int  `json:"scaleFactors"`
+}
+
+// ProfileDescription describes the features supported by the server
+// beyond those implied by the compliance level.
+type ProfileDescription struct {
+	Formats   []string `json:"formats,omitempty"`
+	Qualities []string `json:"qualities,omitempty"`
+	Supports  []string `json:"supports,omitempty"`
+	MaxWidth  int      `json:"maxWidth,omitempty"`
+	MaxHeight int      `json:"maxHeight,omitempty"`
+}
+
+// NewImageInfo returns the image information document for an image of the
+// given size, identified by the URI id, advertising the given tiling.
+func NewImageInfo(id string, size image.Point, tiling Tiling) ImageInfo {
+	formats := make([]string, len(supportedFormats))
+	for i, f := range supportedFormats {
+		formats[i] = string(f)
+	}
+	return ImageInfo{
+		Context:  ContextURI,
+		ID:       id,
+		Protocol: ProtocolURI,
+		Width:    size.X,
+		Height:   size.Y,
+		Sizes:    newSizeInfos(size, tiling, ""),
+		Tiles:    newTileInfos(tiling, ""),
+		Profile: []interface{}{
+			ComplianceLevelURI,
+			ProfileDescription{
+				Formats:   formats,
+				Qualities: supportedQualities,
+				Supports:  supportedFeatures,
+				MaxWidth:  maxScaleSize.X,
+				MaxHeight: maxScaleSize.Y,
+			},
+		},
+	}
+}
+
+// ImageInfo3 is an Image API 3.0 image information document, as described
+// in http://iiif.io/api/image/3.0/#5-image-information.
+type ImageInfo3 struct {
+	Context        string     `json:"@context"`
+	ID             string     `json:"id"`
+	Type           string     `json:"type"`
+	Protocol       string     `json:"protocol"`
+	Profile        string     `json:"profile"`
+	Width          int        `json:"width"`
+	Height         int        `json:"height"`
+	Sizes          []SizeInfo `json:"sizes,omitempty"`
+	Tiles          []TileInfo `json:"tiles,omitempty"`
+	MaxWidth       int        `json:"maxWidth,omitempty"`
+	MaxHeight      int        `json:"maxHeight,omitempty"`
+	MaxArea        int        `json:"maxArea,omitempty"`
+	ExtraFormats   []string   `json:"extraFormats,omitempty"`
+	ExtraQualities []string   `json:"extraQualities,omitempty"`
+	ExtraFeatures  []string   `json:"extraFeatures,omitempty"`
+}
+
+// NewImageInfo3 returns the Image API 3.0 image information document for
+// an image of the given size, identified by the URI id, advertising the
+// given tiling.
+func NewImageInfo3(id string, size image.Point, tiling Tiling) ImageInfo3 {
+	var formats []string
+	for _, f := range supportedFormats {
+		if f != FormatJPEG {
+			formats = append(formats, string(f))
+		}
+	}
+	var qualities []string
+	for _, q := range supportedQualities {
+		if q != QualityStringDefault {
+			qualities = append(qualities, q)
+		}
+	}
+	return ImageInfo3{
+		Context:        ContextURI3,
+		ID:             id,
+		Type:           "ImageService3",
+		Protocol:       ProtocolURI,
+		Profile:        ComplianceLevel3,
+		Width:          size.X,
+		Height:         size.Y,
+		Sizes:          newSizeInfos(size, tiling, "Size"),
+		Tiles:          newTileInfos(tiling, "Tile"),
+		MaxWidth:       maxScaleSize.X,
+		MaxHeight:      maxScaleSize.Y,
+		MaxArea:        maxScaleSize.X * maxScaleSize.Y,
+		ExtraFormats:   formats,
+		ExtraQualities: qualities,
+		ExtraFeatures:  supportedFeatures3,
+	}
+}
+
+func newSizeInfos(size image.Point, tiling Tiling, typ string) []SizeInfo {
+	var sizes []SizeInfo
+	for _, s := range tiling.Sizes(size) {
+		sizes = append(sizes, SizeInfo{Type: typ, Width: s.X, Height: s.Y})
+	}
+	return sizes
+}
+
+func newTileInfos(tiling Tiling, typ string) []TileInfo {
+	if !tiling.Enabled() {
+		return nil
+	}
+	return []TileInfo{{Type: typ, Width: tiling.Width, ScaleFactors: tiling.ScaleFactors}}
+}
+
+var infoSpecRegexp = regexp.MustCompile(`^([^/]+)/info\.json$`)
+
+// ParseInfoSpec parses an image information request, returning the
+// identifier of the image.
+func ParseInfoSpec(spec string) (string, error) {
+	parts := infoSpecRegexp.FindStringSubmatch(spec)
+	if len(parts) != 2 {
+		return "", InvalidSpec{
+			Message: fmt.Sprintf("not a valid info request: %q", spec),
+		}
+	}
+	id, err := url.QueryUnescape(parts[1])
+	if err != nil {
+		return "", InvalidSpec{
+			Message: fmt.Sprintf("not a valid identifier: %q", parts[1]),
+		}
+	}
+	return id, nil
+}
+
+// supportedQualities lists the qualities accepted by ParseSpec.
+var supportedQualities = []string{
+	QualityStringDefault,
+	QualityStringColor,
+	QualityStringGray,
+	QualityStringBitonal,
+}
+
+// supportedFeatures lists the features accepted by ParseSpec, using the
+// names defined in http://iiif.io/api/image/2.1/#profile-description.
+var supportedFeatures = []string{
+	"regionByPx",
+	"regionByPct",
+	"regionSquare",
+	"sizeByW",
+	"sizeByH",
+	"sizeByPct",
+	"sizeByWh",
+	"sizeByConfinedWh",
+	"sizeByDistortedWh",
+	"sizeAboveFull",
+	"rotationBy90s",
+	"rotationArbitrary",
+	"mirroring",
+	"baseUriRedirect",
+	"canonicalLinkHeader",
+	"profileLinkHeader",
+	"jsonldMediaType",
+}
+
+// supportedFeatures3 lists the features accepted by ParseVersionedSpec for
+// Image API 3.0, using the names defined in
+// http://iiif.io/api/image/3.0/#6-compliance-level-and-profile-document.
+var supportedFeatures3 = []string{
+	"regionByPx",
+	"regionByPct",
+	"regionSquare",
+	"sizeByW",
+	"sizeByH",
+	"sizeByPct",
+	"sizeByWh",
+	"sizeByConfinedWh",
+	"sizeUpscaling",
+	"rotationBy90s",
+	"rotationArbitrary",
+	"mirroring",
+	"baseUriRedirect",
+	"canonicalLinkHeader",
+	"profileLinkHeader",
+	"jsonldMediaType",
+}
@@ -0,0 +1,101 @@
+package iiif_test
+
+import (
+	"image"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/t11e/picaxe/iiif"
+)
+
+func TestParseInfoSpec(t *testing.T) {
+	for _, test := range []struct {
+		spec        string
+		expectID    string
+		expectError string
+	}{
+		{spec: "foo/info.json", expectID: "foo"},
+		{spec: "http%3A%2F%2Fi.imgur.com%2FJ1XaOIa.jpg/info.json", expectID: "http://i.imgur.com/J1XaOIa.jpg"},
+		{spec: "info.json", expectError: `not a valid info request: "info.json"`},
+		{spec: "foo/bar/info.json", expectError: `not a valid info request: "foo/bar/info.json"`},
+		{spec: "foo/info.xml", expectError: `not a valid info request: "foo/info.xml"`},
+		{spec: "foo%zz/info.json", expectError: `not a valid identifier: "foo%zz"`},
+	} {
+		t.Run(test.spec, func(t *testing.T) {
+			id, err := iiif.ParseInfoSpec(test.spec)
+			if test.expectError != "" {
+				if assert.Error(t, err) {
+					assert.IsType(t, iiif.InvalidSpec{}, err)
+					assert.Equal(t, test.expectError, err.Error())
+				}
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.expectID, id)
+		})
+	}
+}
+
+func TestNewImageInfo(t *testing.T) {
+	info := iiif.NewImageInfo("http://example.com/iiif/foo", image.Pt(640, 480), iiif.Tiling{})
+	assert.Equal(t, iiif.ContextURI, info.Context)
+	assert.Equal(t, "http://example.com/iiif/foo", info.ID)
+	assert.Equal(t, iiif.ProtocolURI, info.Protocol)
+	assert.Equal(t, 640, info.Width)
+	assert.Equal(t, 480, info.Height)
+	assert.Empty(t, info.Sizes)
+	assert.Empty(t, info.Tiles)
+	if assert.Len(t, info.Profile, 2) {
+		assert.Equal(t, iiif.ComplianceLevelURI, info.Profile[0])
+
+		desc, ok := info.Profile[1].(iiif.ProfileDescription)
+		if assert.True(t, ok) {
+			assert.Equal(t, []string{"jpg", "png", "gif", "webp", "tif", "bmp"}, desc.Formats)
+			assert.Equal(t, []string{"default", "color", "gray", "bitonal"}, desc.Qualities)
+			assert.Contains(t, desc.Supports, "regionByPx")
+			assert.Equal(t, 6000, desc.MaxWidth)
+			assert.Equal(t, 6000, desc.MaxHeight)
+		}
+	}
+}
+
+func TestNewImageInfo3(t *testing.T) {
+	info := iiif.NewImageInfo3("http://example.com/iiif/foo", image.Pt(640, 480), iiif.Tiling{})
+	assert.Equal(t, iiif.ContextURI3, info.Context)
+	assert.Equal(t, "http://example.com/iiif/foo", info.ID)
+	assert.Equal(t, "ImageService3", info.Type)
+	assert.Equal(t, iiif.ProtocolURI, info.Protocol)
+	assert.Equal(t, "level1", info.Profile)
+	assert.Equal(t, 640, info.Width)
+	assert.Equal(t, 480, info.Height)
+	assert.Equal(t, 6000, info.MaxWidth)
+	assert.Equal(t, 6000, info.MaxHeight)
+	assert.Equal(t, 36000000, info.MaxArea)
+	assert.Equal(t, []string{"png", "gif", "webp", "tif", "bmp"}, info.ExtraFormats)
+	assert.Equal(t, []string{"color", "gray", "bitonal"}, info.ExtraQualities)
+	assert.Contains(t, info.ExtraFeatures, "sizeUpscaling")
+	assert.NotContains(t, info.ExtraFeatures, "sizeAboveFull")
+}
+
+func TestNewImageInfo_tiles(t *testing.T) {
+	tiling := iiif.Tiling{Width: 256, ScaleFactors: []int{1, 2, 4, 8}}
+
+	info := iiif.NewImageInfo("http://example.com/iiif/foo", image.Pt(1000, 750), tiling)
+	assert.Equal(t, []iiif.SizeInfo{
+		{Width: 125, Height: 94},
+		{Width: 250, Height: 188},
+		{Width: 500, Height: 375},
+	}, info.Sizes)
+	assert.Equal(t, []iiif.TileInfo{
+		{Width: 256, ScaleFactors: []int{1, 2, 4, 8}},
+	}, info.Tiles)
+
+	info3 := iiif.NewImageInfo3("http://example.com/iiif/foo", image.Pt(1000, 750), tiling)
+	if assert.Len(t, info3.Sizes, 3) {
+		assert.Equal(t, iiif.SizeInfo{Type: "Size", Width: 125, Height: 94}, info3.Sizes[0])
+	}
+	assert.Equal(t, []iiif.TileInfo{
+		{Type: "Tile", Width: 256, ScaleFactors: []int{1, 2, 4, 8}},
+	}, info3.Tiles)
+}
@@ -0,0 +1,158 @@
+package iiif
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"image"
+	"sync"
+
+	"github.com/t11e/picaxe/resources"
+)
+
+// levelKey identifies an image scaled down by a scale factor. It includes
+// the validators of the source, so that a source that changes gets new
+// levels.
+type levelKey struct {
+	identifier  string
+	validators  resources.Validators
+	scaleFactor int
+}
+
+type levelEntry struct {
+	key   levelKey
+	img   image.Image
+	bytes int64
+}
+
+// levelCall is a load in progress, which concurrent callers wait for.
+type levelCall struct {
+	done chan struct{}
+	img  image.Image
+	err  error
+}
+
+// levelCache is an in-memory cache of decoded images at each scale factor,
+// bounded by the approximate number of bytes of pixel data, and evicting
+// the least recently used levels first.
+type levelCache struct {
+	maxBytes int64
+
+	mu      sync.Mutex
+	bytes   int64
+	lru     *list.List
+	entries map[levelKey]*list.Element
+	loading map[levelKey]*levelCall
+}
+
+func newLevelCache(maxBytes int64) *levelCache {
+	return &levelCache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  map[levelKey]*list.Element{},
+		loading:  map[levelKey]*levelCall{},
+	}
+}
+
+// lookup returns a cached level, without loading it.
+func (c *levelCache) lookup(key levelKey) (image.Image, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(e)
+		return e.Value.(*levelEntry).img, true
+	}
+	return nil, false
+}
+
+// get returns a cached level, calling load to create it if necessary.
+// Concurrent callers asking for the same level share a single load, but
+// stop waiting for it if their context is canceled.
+func (c *levelCache) get(
+	ctx context.Context,
+	key levelKey,
+	load func() (image.Image, error)) (image.Image, error) {
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(e)
+		c.mu.Unlock()
+		return e.Value.(*levelEntry).img, nil
+	}
+	if call, ok := c.loading[key]; ok {
+		c.mu.Unlock()
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if call.err == context.Canceled || call.err == context.DeadlineExceeded {
+			// The request that was loading it was canceled, not this one
+			return c.get(ctx, key, load)
+		}
+		return call.img, call.err
+	}
+	call := &levelCall{done: make(chan struct{})}
+	c.loading[key] = call
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.loading, key)
+		if call.err == nil {
+			c.add(key, call.img)
+		}
+		c.mu.Unlock()
+		close(call.done)
+	}()
+
+	// Should load panic, waiters are told that it failed
+	call.err = errLoadFailed
+	call.img, call.err = load()
+	return call.img, call.err
+}
+
+var errLoadFailed = errors.New("loading level failed")
+
+// add inserts a level, evicting others as needed. Levels larger than the
+// whole cache are not kept. The caller must hold c.mu.
+func (c *levelCache) add(key levelKey, img image.Image) {
+	entry := &levelEntry{key: key, img: img, bytes: imageBytes(img)}
+	if entry.bytes > c.maxBytes {
+		return
+	}
+	for c.bytes+entry.bytes > c.maxBytes {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		evicted := oldest.Value.(*levelEntry)
+		delete(c.entries, evicted.key)
+		c.bytes -= evicted.bytes
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.bytes += entry.bytes
+}
+
+// imageBytes returns the approximate memory used by an image's pixels.
+func imageBytes(img image.Image) int64 {
+	switch i := img.(type) {
+	case *image.YCbCr:
+		return int64(len(i.Y) + len(i.Cb) + len(i.Cr))
+	case *image.NRGBA:
+		return int64(len(i.Pix))
+	case *image.RGBA:
+		return int64(len(i.Pix))
+	case *image.NRGBA64:
+		return int64(len(i.Pix))
+	case *image.RGBA64:
+		return int64(len(i.Pix))
+	case *image.Gray:
+		return int64(len(i.Pix))
+	case *image.Gray16:
+		return int64(len(i.Pix))
+	case *image.CMYK:
+		return int64(len(i.Pix))
+	case *image.Paletted:
+		return int64(len(i.Pix))
+	}
+	size := img.Bounds().Size()
+	return int64(size.X) * int64(size.Y) * 4
+}
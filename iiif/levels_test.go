@@ -0,0 +1,31 @@
+package iiif
+
+import (
+	"context"
+	"image"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLevelCache_panic(t *testing.T) {
+	c := newLevelCache(1024)
+	key := levelKey{identifier: "foo", scaleFactor: 1}
+
+	assert.Panics(t, func() {
+		c.get(context.Background(), key, func() (image.Image, error) {
+			panic("failed")
+		})
+	})
+
+	// The level can be loaded again, rather than waiting for the first load
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	img, err := c.get(ctx, key, func() (image.Image, error) {
+		return image.NewGray(image.Rect(0, 0, 1, 1)), nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, image.Pt(1, 1), img.Bounds().Size())
+}
@@ -0,0 +1,180 @@
+package iiif
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"sync"
+)
+
+// ImageTooLarge is returned when the source image has more pixels than the
+// processor is willing to decode.
+type ImageTooLarge struct {
+	Identifier string
+	Size       image.Point
+}
+
+// Error implements interface "error".
+func (err ImageTooLarge) Error() string {
+	return fmt.Sprintf("image %q is too large to process: %dx%d pixels",
+		err.Identifier, err.Size.X, err.Size.Y)
+}
+
+// checkSize returns ImageTooLarge if an image exceeds the processor's
+// limits, or would need more than its whole memory budget.
+func (p *processor) checkSize(identifier string, config image.Config) error {
+	size := image.Pt(config.Width, config.Height)
+	if (p.maxWidth > 0 && size.X > p.maxWidth) ||
+		(p.maxHeight > 0 && size.Y > p.maxHeight) ||
+		(p.maxPixels > 0 && int64(size.X)*int64(size.Y) > p.maxPixels) ||
+		(p.memory != nil && decodedSize(config) > p.memory.max) {
+		return ImageTooLarge{Identifier: identifier, Size: size}
+	}
+	return nil
+}
+
+// decode decodes an image, after checking its size against the processor's
+// limits and adding memory for it to res. The memory must be released once
+// the image is no longer used.
+func (p *processor) decode(
+	ctx context.Context,
+	identifier string,
+	r io.ReadSeeker,
+	res *reservation) (image.Image, error) {
+	config, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if err := p.reserve(ctx, identifier, config, 0, res); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// reservation is the memory reserved from the processor's budget for one
+// request, which is all released together once the request is done.
+type reservation struct {
+	n        int64
+	releases []func()
+}
+
+// release releases all the memory reserved.
+func (res *reservation) release() {
+	for _, release := range res.releases {
+		release()
+	}
+	res.n, res.releases = 0, nil
+}
+
+// reserve checks the size of an image about to be allocated against the
+// processor's limits, and adds memory for it to res, along with extra
+// bytes for any copies made along the way. Memory already in res counts
+// against the budget, so that a request never waits for memory that it
+// holds itself.
+func (p *processor) reserve(
+	ctx context.Context,
+	identifier string,
+	config image.Config,
+	extra int64,
+	res *reservation) error {
+	if err := p.checkSize(identifier, config); err != nil {
+		return err
+	}
+	n := decodedSize(config) + extra
+	if p.memory != nil && res.n+n > p.memory.max {
+		return ImageTooLarge{Identifier: identifier, Size: image.Pt(config.Width, config.Height)}
+	}
+	release, err := p.memory.acquire(ctx, n)
+	if err != nil {
+		return err
+	}
+	res.n += n
+	res.releases = append(res.releases, release)
+	return nil
+}
+
+// decodedSize estimates the memory used by a decoded image.
+func decodedSize(config image.Config) int64 {
+	return int64(config.Width) * int64(config.Height) * bytesPerPixel(config.ColorModel)
+}
+
+// bytesPerPixel estimates the memory used by each pixel of an image decoded
+// with a color model, from the image types that decoders return for it.
+func bytesPerPixel(m color.Model) int64 {
+	if _, ok := m.(color.Palette); ok {
+		return 1
+	}
+	switch m {
+	case color.GrayModel, color.AlphaModel:
+		return 1
+	case color.Gray16Model, color.Alpha16Model:
+		return 2
+	case color.YCbCrModel:
+		return 3
+	case color.RGBA64Model, color.NRGBA64Model:
+		return 8
+	}
+	return 4
+}
+
+// memoryBudget limits the memory used by decoded images across all
+// requests. Requests that don't fit wait until enough is released.
+type memoryBudget struct {
+	max int64
+
+	mu       sync.Mutex
+	used     int64
+	released chan struct{}
+}
+
+// newMemoryBudget returns a budget of max bytes, or nil if max is zero.
+func newMemoryBudget(max int64) *memoryBudget {
+	if max <= 0 {
+		return nil
+	}
+	return &memoryBudget{max: max, released: make(chan struct{})}
+}
+
+// acquire waits until n bytes are available, and returns a function to
+// call to release them. n must not be more than the whole budget.
+func (b *memoryBudget) acquire(ctx context.Context, n int64) (func(), error) {
+	if b == nil {
+		return func() {}, nil
+	}
+	for {
+		b.mu.Lock()
+		if b.used+n <= b.max {
+			b.used += n
+			b.mu.Unlock()
+			var once sync.Once
+			return func() { once.Do(func() { b.release(n) }) }, nil
+		}
+		released := b.released
+		b.mu.Unlock()
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// release returns n bytes to the budget, and wakes up everyone waiting to
+// see whether they now fit.
+func (b *memoryBudget) release(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+	close(b.released)
+	b.released = make(chan struct{})
+}
@@ -1,6 +1,8 @@
 package mocks
 
+import context "context"
 import iiif "github.com/t11e/picaxe/iiif"
+import image "image"
 import io "io"
 import mock "github.com/stretchr/testify/mock"
 import resources "github.com/t11e/picaxe/resources"
@@ -10,13 +12,34 @@ type Processor struct {
 	mock.Mock
 }
 
-// Process provides a mock function with given fields: req, resolver, w, result
-func (_m *Processor) Process(req iiif.Request, resolver resources.Resolver, w io.Writer, result *iiif.Result) error {
-	ret := _m.Called(req, resolver, w, result)
+// Dimensions provides a mock function with given fields: ctx, identifier, resolver
+func (_m *Processor) Dimensions(ctx context.Context, identifier string, resolver resources.Resolver) (image.Point, error) {
+	ret := _m.Called(ctx, identifier, resolver)
+
+	var r0 image.Point
+	if rf, ok := ret.Get(0).(func(context.Context, string, resources.Resolver) image.Point); ok {
+		r0 = rf(ctx, identifier, resolver)
+	} else {
+		r0 = ret.Get(0).(image.Point)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, resources.Resolver) error); ok {
+		r1 = rf(ctx, identifier, resolver)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// Process provides a mock function with given fields: ctx, req, resolver, w, result
+func (_m *Processor) Process(ctx context.Context, req iiif.Request, resolver resources.Resolver, w io.Writer, result *iiif.Result) error {
+	ret := _m.Called(ctx, req, resolver, w, result)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(iiif.Request, resources.Resolver, io.Writer, *iiif.Result) error); ok {
-		r0 = rf(req, resolver, w, result)
+	if rf, ok := ret.Get(0).(func(context.Context, iiif.Request, resources.Resolver, io.Writer, *iiif.Result) error); ok {
+		r0 = rf(ctx, req, resolver, w, result)
 	} else {
 		r0 = ret.Error(0)
 	}
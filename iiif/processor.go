@@ -1,12 +1,20 @@
 package iiif
 
 import (
+	"context"
 	"fmt"
 	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
 	"image/gif"
 	"image/jpeg"
 	"image/png"
 	"io"
+	"math"
+
+	"github.com/chai2010/webp"
+	"golang.org/x/image/bmp"
 
 	"github.com/t11e/picaxe/imageops"
 	"github.com/t11e/picaxe/resources"
@@ -17,36 +25,203 @@ import (
 // maxScaleSize is the largest image we will scale to.
 var maxScaleSize = image.Pt(6000, 6000)
 
+// defaultWebPQuality is used for lossy WebP unless the request specifies
+// a quality. It is the same as libwebp's default.
+const defaultWebPQuality = 75
+
 type Result struct {
 	ContentType string
+
+	// FullSize is the size of the full image that the region was taken
+	// from, after orientation and border trimming.
+	FullSize image.Point
 }
 
 type Processor interface {
+	// Process renders the requested image to w. It stops early with the
+	// context's error if ctx is canceled.
 	Process(
+		ctx context.Context,
 		req Request,
 		resolver resources.Resolver,
 		w io.Writer,
 		result *Result) error
+
+	// Dimensions returns the size of the source image, without decoding
+	// the image data.
+	Dimensions(
+		ctx context.Context,
+		identifier string,
+		resolver resources.Resolver) (image.Point, error)
+}
+
+// ProcessorOptions configures a Processor created by NewProcessor.
+type ProcessorOptions struct {
+	// Tiling is the tiling whose tiles are rendered from cached levels.
+	Tiling Tiling
+
+	// LevelCacheSize is the maximum number of bytes of decoded images to
+	// keep in memory for rendering tiles. Zero disables the cache.
+	LevelCacheSize int64
+
+	// MaxWidth, MaxHeight and MaxPixels limit the size of source images,
+	// and of rotated images. Larger images are rejected with ImageTooLarge
+	// before being decoded or rotated. Zero means no limit.
+	MaxWidth  int
+	MaxHeight int
+	MaxPixels int64
+
+	// MemoryBudget is the maximum number of bytes of decoded source images
+	// and rotated images to hold at once, across all requests. Requests wait for memory to be
+	// released by others, and images larger than the whole budget are
+	// rejected. Zero means no limit. Levels kept for tiles don't count
+	// against it, since LevelCacheSize limits them separately.
+	MemoryBudget int64
 }
 
-type processor struct{}
+type processor struct {
+	tiling    Tiling
+	levels    *levelCache
+	maxWidth  int
+	maxHeight int
+	maxPixels int64
+	memory    *memoryBudget
+}
+
+// NewProcessor returns a Processor with the given options.
+func NewProcessor(opts ProcessorOptions) Processor {
+	p := &processor{
+		tiling:    opts.Tiling,
+		maxWidth:  opts.MaxWidth,
+		maxHeight: opts.MaxHeight,
+		maxPixels: opts.MaxPixels,
+		memory:    newMemoryBudget(opts.MemoryBudget),
+	}
+	if opts.Tiling.Enabled() && opts.LevelCacheSize > 0 {
+		p.levels = newLevelCache(opts.LevelCacheSize)
+	}
+	return p
+}
 
 // Process implements Processor.
-func (processor) Process(
+func (p *processor) Process(
+	ctx context.Context,
 	req Request,
 	resolver resources.Resolver,
 	w io.Writer,
 	result *Result) error {
-	r, err := resolver.GetResource(req.Identifier)
+	var res reservation
+	defer res.release()
+
+	var img image.Image
+	var err error
+	if p.levels != nil && !req.AutoOrient && !req.TrimBorder {
+		img, err = p.scaledRegionFromLevels(ctx, req, resolver, result, &res)
+	} else {
+		img, err = p.scaledRegion(ctx, req, nil, resolver, result, &res)
+	}
 	if err != nil {
 		return err
 	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
-	img, _, err := image.Decode(r)
-	if err != nil {
+	if req.Rotation.Mirror {
+		img = imageops.Mirror(img)
+	}
+	if img, err = p.rotate(ctx, req, img, &res); err != nil {
 		return err
 	}
 
+	switch req.Quality {
+	case QualityGray:
+		img = imageops.Grayscale(img)
+	case QualityBitonal:
+		img = imageops.Bitonal(img, req.Dither)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	switch req.Format {
+	case FormatPNG:
+		if result != nil {
+			result.ContentType = "image/png"
+		}
+		return png.Encode(w, img)
+	case FormatJPEG:
+		if result != nil {
+			result.ContentType = "image/jpeg"
+		}
+		return jpeg.Encode(w, img, &jpeg.Options{
+			Quality: 98,
+		})
+	case FormatGIF:
+		if result != nil {
+			result.ContentType = "image/gif"
+		}
+		if o, ok := img.(opaqueImage); ok && !o.Opaque() {
+			img = toPalettedWithTransparency(img)
+		}
+		return gif.Encode(w, img, &gif.Options{
+			NumColors: 256,
+			Quantizer: nil,
+			Drawer:    nil,
+		})
+	case FormatWebP:
+		if result != nil {
+			result.ContentType = "image/webp"
+		}
+		quality := req.WebPQuality
+		if quality == 0 {
+			quality = defaultWebPQuality
+		}
+		return webp.Encode(w, img, &webp.Options{
+			Lossless: req.WebPLossless,
+			Quality:  float32(quality),
+		})
+	case FormatTIFF:
+		if result != nil {
+			result.ContentType = "image/tiff"
+		}
+		return imageops.EncodeTIFF(w, img, req.TIFFCompression)
+	case FormatBMP:
+		if result != nil {
+			result.ContentType = "image/bmp"
+		}
+		return bmp.Encode(w, img)
+	}
+
+	return fmt.Errorf("Unexpected format %q", req.Format)
+}
+
+// scaledRegion decodes the image, and returns the requested region of it
+// scaled to the requested size. The memory used for decoding is added to
+// res. If r is nil, the image is fetched from the resolver.
+func (p *processor) scaledRegion(
+	ctx context.Context,
+	req Request,
+	r *resources.Resource,
+	resolver resources.Resolver,
+	result *Result,
+	res *reservation) (image.Image, error) {
+	if r == nil {
+		var err error
+		if r, err = resolver.GetResource(ctx, req.Identifier); err != nil {
+			return nil, err
+		}
+		defer r.Close()
+	}
+
+	img, err := p.decode(ctx, req.Identifier, r, res)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	if req.AutoOrient {
 		r.Seek(0, 0)
 		metadata := imageops.NewMetadataFromReader(r)
@@ -59,6 +234,13 @@ func (processor) Process(
 
 	if req.TrimBorder {
 		img = imageops.Trim(img, req.TrimBorderFuzziness)
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	if result != nil {
+		result.FullSize = img.Bounds().Size()
 	}
 
 	switch req.Region.Kind {
@@ -72,35 +254,168 @@ func (processor) Process(
 
 	dims, err := req.Size.CalculateDimensions(img.Bounds().Size(), maxScaleSize)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	img = imageops.Scale(img, dims)
+	return imageops.Scale(img, dims), nil
+}
 
-	switch req.Format {
-	case FormatPNG:
-		if result != nil {
-			result.ContentType = "image/png"
+// scaledRegionFromLevels is like scaledRegion, but renders requests that
+// match the tiling from cached levels of the image, so that the source
+// image is only decoded and scaled once for all of its tiles. The source
+// is still fetched for every request, so that levels of a source that has
+// changed aren't used. Sources without an ETag or Last-Modified time can't
+// be told apart from the next version, so they are rendered as usual. The
+// memory reserved for decoding is released once the level is cached,
+// since the level cache limits its own size, so only requests that don't
+// match the tiling add memory to res.
+func (p *processor) scaledRegionFromLevels(
+	ctx context.Context,
+	req Request,
+	resolver resources.Resolver,
+	result *Result,
+	res *reservation) (image.Image, error) {
+	r, err := resolver.GetResource(ctx, req.Identifier)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	if r.Validators().IsZero() {
+		return p.scaledRegion(ctx, req, r, resolver, result, res)
+	}
+	key := func(scaleFactor int) levelKey {
+		return levelKey{req.Identifier, r.Validators(), scaleFactor}
+	}
+
+	var full image.Point
+	if src, ok := p.levels.lookup(key(1)); ok {
+		full = src.Bounds().Size()
+	} else {
+		config, _, err := image.DecodeConfig(r)
+		if err != nil {
+			return nil, err
 		}
-		return png.Encode(w, img)
-	case FormatJPEG:
-		if result != nil {
-			result.ContentType = "image/jpeg"
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return nil, err
 		}
-		return jpeg.Encode(w, img, &jpeg.Options{
-			Quality: 98,
-		})
-	case FormatGIF:
-		if result != nil {
-			result.ContentType = "image/gif"
+		full = image.Pt(config.Width, config.Height)
+		if err := p.checkSize(req.Identifier, config); err != nil {
+			return nil, err
 		}
-		return gif.Encode(w, img, &gif.Options{
-			NumColors: 256,
-			Quantizer: nil,
-			Drawer:    nil,
-		})
 	}
 
-	return fmt.Errorf("Unexpected format %q", req.Format)
+	rect := req.Region.Rectangle(full)
+	dims, err := req.Size.CalculateDimensions(rect.Size(), maxScaleSize)
+	if err != nil {
+		return nil, err
+	}
+	scaleFactor, ok := p.tiling.scaleFactor(rect, dims)
+	if !ok {
+		return p.scaledRegion(ctx, req, r, resolver, result, res)
+	}
+
+	loadSource := func() (image.Image, error) {
+		var res reservation
+		defer res.release()
+		return p.decode(ctx, req.Identifier, r, &res)
+	}
+	level, err := p.levels.get(ctx, key(scaleFactor), func() (image.Image, error) {
+		if scaleFactor == 1 {
+			return loadSource()
+		}
+		src, err := p.levels.get(ctx, key(1), loadSource)
+		if err != nil {
+			return nil, err
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return imageops.Scale(src, scaledSize(src.Bounds().Size(), scaleFactor)), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if result != nil {
+		result.FullSize = full
+	}
+
+	min := rect.Min.Div(scaleFactor)
+	img := imageops.CropRect(level, image.Rectangle{Min: min, Max: min.Add(dims)})
+	return imageops.Scale(img, dims), nil
+}
+
+// rotate rotates an image as requested, after checking the size of the
+// rotated image against the processor's limits and adding memory to res
+// for it, and for the copy that rotating by other than a right angle
+// makes.
+func (p *processor) rotate(
+	ctx context.Context,
+	req Request,
+	img image.Image,
+	res *reservation) (image.Image, error) {
+	degrees := req.Rotation.Degrees
+	if math.Mod(degrees, 360) == 0 {
+		return img, nil
+	}
+
+	size := img.Bounds().Size()
+	rotated := imageops.RotatedSize(size, degrees)
+	var extra int64
+	if math.Mod(degrees, 90) != 0 {
+		extra = decodedSize(image.Config{ColorModel: color.NRGBAModel, Width: size.X, Height: size.Y})
+	}
+	config := image.Config{ColorModel: color.NRGBAModel, Width: rotated.X, Height: rotated.Y}
+	if err := p.reserve(ctx, req.Identifier, config, extra, res); err != nil {
+		return nil, err
+	}
+	return imageops.Rotate(ctx, img, degrees, backgroundColor(req))
+}
+
+// backgroundColor returns the color used to fill areas not covered by the
+// image, such as the corners left by rotation. Only formats without an
+// alpha channel get a solid color.
+func backgroundColor(req Request) color.Color {
+	if req.Format.hasAlpha() {
+		return color.Transparent
+	}
+	if req.Background != nil {
+		return *req.Background
+	}
+	return color.White
+}
+
+type opaqueImage interface {
+	Opaque() bool
+}
+
+// gifPalette is the Plan 9 palette used by the GIF encoder, with one entry
+// given up for transparency.
+var gifPalette = append(color.Palette{color.Transparent}, palette.Plan9[:255]...)
+
+func toPalettedWithTransparency(img image.Image) *image.Paletted {
+	bounds := img.Bounds()
+	p := image.NewPaletted(bounds, gifPalette)
+	draw.FloydSteinberg.Draw(p, bounds, img, bounds.Min)
+	return p
+}
+
+// Dimensions implements Processor.
+func (*processor) Dimensions(
+	ctx context.Context,
+	identifier string,
+	resolver resources.Resolver) (image.Point, error) {
+	r, err := resolver.GetResource(ctx, identifier)
+	if err != nil {
+		return image.Point{}, err
+	}
+	defer r.Close()
+
+	config, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return image.Point{}, err
+	}
+	return image.Pt(config.Width, config.Height), nil
 }
 
-var DefaultProcessor = processor{}
+// DefaultProcessor is a Processor without tiling.
+var DefaultProcessor = NewProcessor(ProcessorOptions{})
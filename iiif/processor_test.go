@@ -0,0 +1,307 @@
+package iiif_test
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/t11e/picaxe/iiif"
+	"github.com/t11e/picaxe/resources"
+	resources_mocks "github.com/t11e/picaxe/resources/mocks"
+)
+
+func TestProcessor_tiles(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 1000, 750))
+	for y := 0; y < 750; y++ {
+		for x := 0; x < 1000; x++ {
+			src.SetNRGBA(x, y, color.NRGBA{uint8(x), uint8(y), 0, 255})
+		}
+	}
+	var encoded bytes.Buffer
+	require.NoError(t, png.Encode(&encoded, src))
+
+	resolver := &resources_mocks.Resolver{}
+	resolver.On("GetResource", mock.Anything, "foo").Return(func(context.Context, string) *resources.Resource {
+		r := resources.NewResource(encoded.Bytes())
+		r.ETag = `"1"`
+		return r
+	}, nil)
+
+	processor := iiif.NewProcessor(iiif.ProcessorOptions{
+		Tiling:         iiif.Tiling{Width: 256, ScaleFactors: []int{1, 2, 4, 8}},
+		LevelCacheSize: 64 * 1024 * 1024,
+	})
+
+	for _, test := range []struct {
+		spec    string
+		size    image.Point
+		fetches int
+	}{
+		{"foo/512,512,488,238/244,/0/default.png", image.Pt(244, 119), 1},
+		{"foo/0,0,512,512/256,/0/default.png", image.Pt(256, 256), 2},
+		{"foo/0,0,1000,750/125,/0/default.png", image.Pt(125, 94), 3},
+		{"foo/256,256,256,256/full/0/default.png", image.Pt(256, 256), 4},
+		{"foo/full/100,/0/default.png", image.Pt(100, 75), 5},
+	} {
+		t.Run(test.spec, func(t *testing.T) {
+			req, err := iiif.ParseSpec(test.spec)
+			require.NoError(t, err)
+
+			var buf bytes.Buffer
+			var result iiif.Result
+			require.NoError(t, processor.Process(context.Background(), *req, resolver, &buf, &result))
+			assert.Equal(t, image.Pt(1000, 750), result.FullSize)
+
+			img, err := png.Decode(&buf)
+			require.NoError(t, err)
+			assert.Equal(t, test.size, img.Bounds().Size())
+			resolver.AssertNumberOfCalls(t, "GetResource", test.fetches)
+		})
+	}
+}
+
+func TestProcessor_tilesChangedSource(t *testing.T) {
+	encode := func(c color.Gray) []byte {
+		src := image.NewGray(image.Rect(0, 0, 512, 512))
+		for i := range src.Pix {
+			src.Pix[i] = c.Y
+		}
+		var encoded bytes.Buffer
+		require.NoError(t, png.Encode(&encoded, src))
+		return encoded.Bytes()
+	}
+
+	var current *resources.Resource
+	resolver := &resources_mocks.Resolver{}
+	resolver.On("GetResource", mock.Anything, "foo").Return(func(context.Context, string) *resources.Resource {
+		return current
+	}, nil)
+
+	processor := iiif.NewProcessor(iiif.ProcessorOptions{
+		Tiling:         iiif.Tiling{Width: 256, ScaleFactors: []int{1, 2}},
+		LevelCacheSize: 64 * 1024 * 1024,
+	})
+	req, err := iiif.ParseSpec("foo/0,0,256,256/256,/0/gray.png")
+	require.NoError(t, err)
+
+	for _, test := range []struct {
+		etag  string
+		color color.Gray
+	}{
+		{`"1"`, color.Gray{10}},
+		{`"1"`, color.Gray{20}},
+		{`"2"`, color.Gray{30}},
+		{"", color.Gray{40}},
+		{"", color.Gray{50}},
+	} {
+		current = resources.NewResource(encode(test.color))
+		current.ETag = test.etag
+
+		var buf bytes.Buffer
+		require.NoError(t, processor.Process(context.Background(), *req, resolver, &buf, nil))
+		img, err := png.Decode(&buf)
+		require.NoError(t, err)
+
+		// Levels are used for as long as the source's ETag is unchanged, and
+		// not at all without one
+		expected := test.color
+		if test.etag == `"1"` {
+			expected = color.Gray{10}
+		}
+		assert.Equal(t, expected, color.GrayModel.Convert(img.At(0, 0)), test.etag)
+	}
+}
+
+func TestProcessor_canceled(t *testing.T) {
+	var encoded bytes.Buffer
+	require.NoError(t, png.Encode(&encoded, image.NewNRGBA(image.Rect(0, 0, 100, 100))))
+
+	resolver := &resources_mocks.Resolver{}
+	resolver.On("GetResource", mock.Anything, "foo").Return(resources.NewResource(encoded.Bytes()), nil)
+
+	req, err := iiif.ParseSpec("foo/full/full/0/default.png")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var buf bytes.Buffer
+	err = iiif.DefaultProcessor.Process(ctx, *req, resolver, &buf, nil)
+	assert.Equal(t, context.Canceled, err)
+	assert.Zero(t, buf.Len())
+}
+
+func TestProcessor_imageTooLarge(t *testing.T) {
+	var encoded bytes.Buffer
+	require.NoError(t, png.Encode(&encoded, image.NewNRGBA(image.Rect(0, 0, 200, 100))))
+
+	resolver := &resources_mocks.Resolver{}
+	resolver.On("GetResource", mock.Anything, "foo").Return(func(context.Context, string) *resources.Resource {
+		return resources.NewResource(encoded.Bytes())
+	}, nil)
+
+	for _, test := range []struct {
+		name      string
+		opts      iiif.ProcessorOptions
+		expectErr bool
+	}{
+		{"no limits", iiif.ProcessorOptions{}, false},
+		{"within limits", iiif.ProcessorOptions{MaxWidth: 200, MaxHeight: 100, MaxPixels: 20000}, false},
+		{"too wide", iiif.ProcessorOptions{MaxWidth: 199}, true},
+		{"too tall", iiif.ProcessorOptions{MaxHeight: 99}, true},
+		{"too many pixels", iiif.ProcessorOptions{MaxPixels: 19999}, true},
+		{"within memory budget", iiif.ProcessorOptions{MemoryBudget: 80000}, false},
+		{"over memory budget", iiif.ProcessorOptions{MemoryBudget: 79999}, true},
+		{"too many pixels for tiles", iiif.ProcessorOptions{
+			Tiling:         iiif.Tiling{Width: 256, ScaleFactors: []int{1}},
+			LevelCacheSize: 1024 * 1024,
+			MaxPixels:      19999,
+		}, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := iiif.ParseSpec("foo/full/full/0/default.png")
+			require.NoError(t, err)
+
+			var buf bytes.Buffer
+			err = iiif.NewProcessor(test.opts).Process(context.Background(), *req, resolver, &buf, nil)
+			if test.expectErr {
+				assert.Equal(t, iiif.ImageTooLarge{Identifier: "foo", Size: image.Pt(200, 100)}, err)
+				assert.Zero(t, buf.Len())
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestProcessor_rotationLimits(t *testing.T) {
+	var encoded bytes.Buffer
+	require.NoError(t, png.Encode(&encoded, image.NewNRGBA(image.Rect(0, 0, 200, 100))))
+
+	resolver := &resources_mocks.Resolver{}
+	resolver.On("GetResource", mock.Anything, "foo").Return(func(context.Context, string) *resources.Resource {
+		return resources.NewResource(encoded.Bytes())
+	}, nil)
+
+	for _, test := range []struct {
+		name       string
+		rotation   string
+		opts       iiif.ProcessorOptions
+		expectSize image.Point
+	}{
+		{"within limits", "45", iiif.ProcessorOptions{MaxPixels: 213 * 213, MemoryBudget: 2*80000 + 213*213*4}, image.Point{}},
+		{"too many pixels", "45", iiif.ProcessorOptions{MaxPixels: 213*213 - 1}, image.Pt(213, 213)},
+		{"too tall", "90", iiif.ProcessorOptions{MaxHeight: 199}, image.Pt(100, 200)},
+		// The source, its copy and the rotated image must all fit at once
+		{"over memory budget", "45", iiif.ProcessorOptions{MemoryBudget: 2*80000 + 213*213*4 - 1}, image.Pt(213, 213)},
+		{"right angle over memory budget", "90", iiif.ProcessorOptions{MemoryBudget: 2*80000 - 1}, image.Pt(100, 200)},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := iiif.ParseSpec("foo/full/full/" + test.rotation + "/default.png")
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			err = iiif.NewProcessor(test.opts).Process(ctx, *req, resolver, ioutil.Discard, nil)
+			if test.expectSize != (image.Point{}) {
+				assert.Equal(t, iiif.ImageTooLarge{Identifier: "foo", Size: test.expectSize}, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestProcessor_memoryBudget(t *testing.T) {
+	var encoded bytes.Buffer
+	require.NoError(t, png.Encode(&encoded, image.NewNRGBA(image.Rect(0, 0, 200, 100))))
+
+	resolver := &resources_mocks.Resolver{}
+	resolver.On("GetResource", mock.Anything, "foo").Return(func(context.Context, string) *resources.Resource {
+		return resources.NewResource(encoded.Bytes())
+	}, nil)
+
+	// The budget fits one image at a time, so each request must release
+	// its memory for the next to go ahead
+	processor := iiif.NewProcessor(iiif.ProcessorOptions{MemoryBudget: 80000})
+	req, err := iiif.ParseSpec("foo/full/full/0/default.png")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, processor.Process(ctx, *req, resolver, ioutil.Discard, nil))
+	}
+}
+
+func TestProcessor_memoryBudgetColorModels(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		img       image.Image
+		budget    int64
+		expectErr bool
+	}{
+		{"gray", image.NewGray(image.Rect(0, 0, 200, 100)), 20000, false},
+		{"8-bit color", image.NewNRGBA(image.Rect(0, 0, 200, 100)), 80000, false},
+		{"16-bit color", image.NewNRGBA64(image.Rect(0, 0, 200, 100)), 80000, true},
+		{"16-bit color within budget", image.NewNRGBA64(image.Rect(0, 0, 200, 100)), 160000, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var encoded bytes.Buffer
+			require.NoError(t, png.Encode(&encoded, test.img))
+
+			resolver := &resources_mocks.Resolver{}
+			resolver.On("GetResource", mock.Anything, "foo").Return(resources.NewResource(encoded.Bytes()), nil)
+
+			req, err := iiif.ParseSpec("foo/full/full/0/default.png")
+			require.NoError(t, err)
+
+			processor := iiif.NewProcessor(iiif.ProcessorOptions{MemoryBudget: test.budget})
+			err = processor.Process(context.Background(), *req, resolver, ioutil.Discard, nil)
+			if test.expectErr {
+				assert.IsType(t, iiif.ImageTooLarge{}, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestProcessor_rotationBackground(t *testing.T) {
+	var encoded bytes.Buffer
+	require.NoError(t, png.Encode(&encoded, image.NewGray(image.Rect(0, 0, 100, 100))))
+
+	resolver := &resources_mocks.Resolver{}
+	resolver.On("GetResource", mock.Anything, "foo").Return(func(context.Context, string) *resources.Resource {
+		return resources.NewResource(encoded.Bytes())
+	}, nil)
+
+	for _, test := range []struct {
+		spec     string
+		expected color.NRGBA
+	}{
+		{"foo/full/full/45/default.bmp?background=ff0000", color.NRGBA{255, 0, 0, 255}},
+		{"foo/full/full/45/default.bmp", color.NRGBA{255, 255, 255, 255}},
+		{"foo/full/full/45/default.png?background=ff0000", color.NRGBA{0, 0, 0, 0}},
+	} {
+		t.Run(test.spec, func(t *testing.T) {
+			req, err := iiif.ParseSpec(test.spec)
+			require.NoError(t, err)
+
+			var buf bytes.Buffer
+			require.NoError(t, iiif.DefaultProcessor.Process(context.Background(), *req, resolver, &buf, nil))
+			img, _, err := image.Decode(&buf)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, color.NRGBAModel.Convert(img.At(0, 0)))
+		})
+	}
+}
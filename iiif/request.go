@@ -3,6 +3,7 @@ package iiif
 import (
 	"fmt"
 	"image"
+	"image/color"
 	"math"
 	"net/url"
 	"regexp"
@@ -61,6 +62,27 @@ func (r Region) String() string {
 	panic(fmt.Sprintf("invalid region kind %v", r.Kind))
 }
 
+// Rectangle returns the pixel rectangle that the region covers in a full
+// image of the given size.
+func (r Region) Rectangle(full image.Point) image.Rectangle {
+	bounds := image.Rectangle{Max: full}
+	switch r.Kind {
+	case RegionKindSquare:
+		side := full.X
+		if full.Y < side {
+			side = full.Y
+		}
+		// Same as imageops.CropSquare
+		min := image.Pt(full.X/2-side/2, full.Y/2-side/2)
+		return image.Rectangle{Min: min, Max: min.Add(image.Pt(side, side))}
+	case RegionKindAbsolute:
+		return r.Absolute.Intersect(bounds)
+	case RegionKindRelative:
+		return r.Relative.ToRectangle(bounds)
+	}
+	return bounds
+}
+
 const (
 	SizeStringFull = "full"
 	SizeStringMax  = "max"
@@ -76,6 +98,25 @@ const (
 	SizeKindRelative
 )
 
+const SizeStringUpscale = "^"
+
+// Upscaling determines whether a size may be larger than the region.
+type Upscaling int
+
+const (
+	// UpscalingAllowed is the IIIF 2.1 behavior: explicit sizes may exceed
+	// the region, while "max" never does.
+	UpscalingAllowed Upscaling = iota
+
+	// UpscalingForbidden is the IIIF 3.0 behavior for sizes without the
+	// "^" prefix: sizes exceeding the region are rejected.
+	UpscalingForbidden
+
+	// UpscalingRequested is the IIIF 3.0 behavior for sizes with the "^"
+	// prefix: any size may exceed the region, including "max".
+	UpscalingRequested
+)
+
 type Size struct {
 	Kind            SizeKind
 	AbsWidth        *int
@@ -83,6 +124,7 @@ type Size struct {
 	AbsBestFit      bool
 	AbsDoNotEnlarge bool
 	Relative        *float64
+	Upscaling       Upscaling
 }
 
 func (s Size) String() string {
@@ -115,7 +157,7 @@ func (s Size) CalculateDimensions(in, maxSize image.Point) (image.Point, error)
 	case SizeKindFull:
 		result = in
 	case SizeKindMax:
-		if in.X > maxSize.X || in.Y > maxSize.Y {
+		if s.Upscaling == UpscalingRequested || in.X > maxSize.X || in.Y > maxSize.Y {
 			result = imageops.FitDimensions(in, &maxSize.X, &maxSize.Y)
 		} else {
 			result = in
@@ -126,7 +168,10 @@ func (s Size) CalculateDimensions(in, maxSize image.Point) (image.Point, error)
 		} else {
 			result = image.Pt(*s.AbsWidth, *s.AbsHeight)
 		}
-		if s.AbsDoNotEnlarge && (result.X > in.X || result.Y > in.Y) {
+		// Best fit must be "as large as possible but not larger than the
+		// region", so it is clamped rather than rejected
+		enlarged := result.X > in.X || result.Y > in.Y
+		if enlarged && (s.AbsDoNotEnlarge || (s.AbsBestFit && s.Upscaling == UpscalingForbidden)) {
 			result = in
 		}
 	case SizeKindRelative:
@@ -136,41 +181,158 @@ func (s Size) CalculateDimensions(in, maxSize image.Point) (image.Point, error)
 	default:
 		panic("Invalid size specification")
 	}
+	if s.Upscaling == UpscalingForbidden && (result.X > in.X || result.Y > in.Y) {
+		return image.Point{}, InvalidSpec{
+			Message: fmt.Sprintf("(%d, %d) exceeds region dimensions (%d, %d) without %q",
+				result.X, result.Y, in.X, in.Y, SizeStringUpscale),
+		}
+	}
 	return checkDimensions(maxSize, result)
 }
 
 func checkDimensions(maxSize, size image.Point) (image.Point, error) {
 	if size.X > maxSize.X || size.Y > maxSize.Y {
-		return image.Point{}, fmt.Errorf("(%d, %d) exceeds maximum allowed dimensions (%d, %d)",
-			size.X, size.Y, maxSize.X, maxSize.Y)
+		return image.Point{}, InvalidSpec{
+			Message: fmt.Sprintf("(%d, %d) exceeds maximum allowed dimensions (%d, %d)",
+				size.X, size.Y, maxSize.X, maxSize.Y),
+		}
 	}
 	return size, nil
 }
 
+const RotationStringMirror = "!"
+
+// Rotation is a clockwise rotation in degrees, optionally preceded by
+// mirroring the image horizontally.
+type Rotation struct {
+	Degrees float64
+	Mirror  bool
+}
+
+func (r Rotation) String() string {
+	s := formatCompactFloat(r.Degrees)
+	if r.Mirror {
+		return RotationStringMirror + s
+	}
+	return s
+}
+
+// IsIdentity returns true if the rotation leaves the image unchanged.
+func (r Rotation) IsIdentity() bool {
+	return r.Degrees == 0 && !r.Mirror
+}
+
+const (
+	QualityStringDefault = "default"
+	QualityStringColor   = "color"
+	QualityStringGray    = "gray"
+	QualityStringBitonal = "bitonal"
+)
+
+// Quality is the color quality of the image. Since our default quality is
+// color, QualityDefault covers both "default" and "color".
+type Quality int
+
+const (
+	QualityDefault Quality = iota
+	QualityGray
+	QualityBitonal
+)
+
+func (q Quality) String() string {
+	switch q {
+	case QualityDefault:
+		return QualityStringDefault
+	case QualityGray:
+		return QualityStringGray
+	case QualityBitonal:
+		return QualityStringBitonal
+	}
+	panic(fmt.Sprintf("invalid quality %d", q))
+}
+
 type Format string
 
 const (
 	FormatJPEG = "jpg"
 	FormatPNG  = "png"
 	FormatGIF  = "gif"
+	FormatWebP = "webp"
+	FormatTIFF = "tif"
+	FormatBMP  = "bmp"
 )
 
+// hasAlpha returns whether images encoded in the format can be transparent.
+func (f Format) hasAlpha() bool {
+	return f != FormatJPEG && f != FormatBMP
+}
+
 type Request struct {
 	Identifier          string
 	Region              Region
 	Size                Size
+	Rotation            Rotation
+	Quality             Quality
 	Format              Format
 	AutoOrient          bool
 	TrimBorder          bool
 	TrimBorderFuzziness float64
+	Background          *color.NRGBA
+	Dither              bool
+	WebPLossless        bool
+	WebPQuality         float64
+	TIFFCompression     imageops.TIFFCompression
 }
 
+// APIVersion is a version of the IIIF Image API.
+type APIVersion int
+
+const (
+	APIVersion2 APIVersion = iota
+	APIVersion3
+)
+
+// String returns the request in IIIF Image API 2.1 syntax.
 func (r Request) String() string {
-	s := fmt.Sprintf("%s/%s/%s/%s.%s",
+	return r.VersionedString(APIVersion2)
+}
+
+// VersionedString returns the request in the syntax of the given version.
+func (r Request) VersionedString(version APIVersion) string {
+	// The rotation was originally omitted when unrotated; keep it that way
+	// so that existing ETags remain valid
+	return r.format(version, version != APIVersion2)
+}
+
+// Path returns the request as a URL path relative to the base URI of the
+// image service, in the syntax of the given version.
+func (r Request) Path(version APIVersion) string {
+	return r.format(version, true)
+}
+
+func (r Request) format(version APIVersion, withIdentityRotation bool) string {
+	path := []string{
 		url.QueryEscape(r.Identifier),
 		r.Region.String(),
-		r.Size.String(),
-		"default",
+	}
+	switch version {
+	case APIVersion2:
+		path = append(path, r.Size.String())
+		if withIdentityRotation || !r.Rotation.IsIdentity() {
+			path = append(path, r.Rotation.String())
+		}
+	case APIVersion3:
+		size := r.Size.String()
+		if r.Size.Upscaling == UpscalingRequested {
+			size = SizeStringUpscale + size
+		}
+		path = append(path, size, r.Rotation.String())
+	default:
+		panic(fmt.Sprintf("invalid API version %d", version))
+	}
+	s := fmt.Sprintf("%s/%s.%s",
+		strings.Join(path, "/"),
+		r.Quality.String(),
 		string(r.Format))
 
 	extra := make([]string, 0, 3)
@@ -184,6 +346,25 @@ func (r Request) String() string {
 	if r.Size.AbsDoNotEnlarge {
 		extra = append(extra, "scale=down")
 	}
+	if r.Background != nil && !r.Format.hasAlpha() {
+		extra = append(extra, fmt.Sprintf("background=%02x%02x%02x",
+			r.Background.R, r.Background.G, r.Background.B))
+	}
+	// Options that don't apply to the quality or format are left out, so
+	// that they don't make a different string for the same image
+	if r.Dither && r.Quality == QualityBitonal {
+		extra = append(extra, "dither=true")
+	}
+	if r.WebPLossless && r.Format == FormatWebP {
+		extra = append(extra, "webpLossless=true")
+	}
+	if r.WebPQuality != 0 && r.Format == FormatWebP {
+		extra = append(extra, fmt.Sprintf("webpQuality=%s",
+			formatCompactFloat(r.WebPQuality)))
+	}
+	if r.TIFFCompression != imageops.TIFFCompressionDeflate && r.Format == FormatTIFF {
+		extra = append(extra, "tiffCompression="+r.TIFFCompression.String())
+	}
 	if len(extra) > 0 {
 		s += "?" + strings.Join(extra, "&")
 	}
@@ -192,7 +373,13 @@ func (r Request) String() string {
 
 var specRegexp = regexp.MustCompile(`([^/]+)/([^/]+)/([^/]+)/([^/]+)/([^.]+)\.([^?]+)(?:\?(.*))?$`)
 
+// ParseSpec parses a request in IIIF Image API 2.1 syntax.
 func ParseSpec(spec string) (*Request, error) {
+	return ParseVersionedSpec(APIVersion2, spec)
+}
+
+// ParseVersionedSpec parses a request in the syntax of the given version.
+func ParseVersionedSpec(version APIVersion, spec string) (*Request, error) {
 	parts := specRegexp.FindStringSubmatch(spec)
 	if len(parts) != 8 {
 		return nil, InvalidSpec{
@@ -212,30 +399,25 @@ func ParseSpec(spec string) (*Request, error) {
 		return nil, err
 	}
 
-	if err := parseSize(parts[3], &req.Size); err != nil {
-		return nil, err
+	switch version {
+	case APIVersion2:
+		if err := parseSize(parts[3], &req.Size); err != nil {
+			return nil, err
+		}
+	case APIVersion3:
+		if err := parseSize3(parts[3], &req.Size); err != nil {
+			return nil, err
+		}
+	default:
+		panic(fmt.Sprintf("invalid API version %d", version))
 	}
 
-	if rotation := parts[4]; rotation != "" {
-		switch rotation {
-		case "0":
-			// OK
-		default:
-			return nil, InvalidSpec{
-				Message: fmt.Sprintf("unsupported rotation %q", rotation),
-			}
-		}
+	if err := parseRotation(parts[4], &req.Rotation); err != nil {
+		return nil, err
 	}
 
-	if quality := parts[5]; quality != "" {
-		switch quality {
-		case "color", "default":
-			// OK
-		default:
-			return nil, InvalidSpec{
-				Message: fmt.Sprintf("unsupported quality %q", quality),
-			}
-		}
+	if err := parseQuality(parts[5], &req.Quality); err != nil {
+		return nil, err
 	}
 
 	if name, ok := formatNameMap[parts[6]]; ok {
@@ -276,6 +458,44 @@ func ParseSpec(spec string) (*Request, error) {
 				return nil, InvalidSpec{Message: fmt.Sprintf(`not a valid scale: "%s"`, t)}
 			}
 		}
+
+		if t := values.Get("dither"); t != "" {
+			req.Dither, err = parseBoolean(t)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if t := values.Get("webpLossless"); t != "" {
+			req.WebPLossless, err = parseBoolean(t)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if t := values.Get("webpQuality"); t != "" {
+			req.WebPQuality, err = parseFloat(t, 1, 100)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if t := values.Get("tiffCompression"); t != "" {
+			if c, ok := tiffCompressionNameMap[t]; ok {
+				req.TIFFCompression = c
+			} else {
+				return nil, InvalidSpec{
+					Message: fmt.Sprintf("unsupported TIFF compression %q", t),
+				}
+			}
+		}
+
+		if t := values.Get("background"); t != "" {
+			req.Background, err = parseHexColor(t)
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	return &req, nil
@@ -334,6 +554,57 @@ func parseRegion(regionValue string, region *Region) error {
 	return err
 }
 
+func parseRotation(rotationValue string, rotation *Rotation) error {
+	degrees := rotationValue
+	if strings.HasPrefix(degrees, RotationStringMirror) {
+		rotation.Mirror = true
+		degrees = degrees[len(RotationStringMirror):]
+	}
+
+	if !rotationRegexp.MatchString(degrees) {
+		return InvalidSpec{
+			Message: fmt.Sprintf("unsupported rotation %q", rotationValue),
+		}
+	}
+
+	var err error
+	rotation.Degrees, err = parseFloat(degrees, 0, 360)
+	return err
+}
+
+var rotationRegexp = regexp.MustCompile(`^[\d]+(?:\.[\d]+)?$`)
+
+func parseQuality(qualityValue string, quality *Quality) error {
+	switch qualityValue {
+	case QualityStringDefault, QualityStringColor:
+		*quality = QualityDefault
+	case QualityStringGray:
+		*quality = QualityGray
+	case QualityStringBitonal:
+		*quality = QualityBitonal
+	default:
+		return InvalidSpec{
+			Message: fmt.Sprintf("unsupported quality %q", qualityValue),
+		}
+	}
+	return nil
+}
+
+func parseHexColor(value string) (*color.NRGBA, error) {
+	if len(value) != 6 {
+		return nil, InvalidSpec{
+			Message: fmt.Sprintf("not a valid color: %q", value),
+		}
+	}
+	v, err := strconv.ParseUint(value, 16, 32)
+	if err != nil {
+		return nil, InvalidSpec{
+			Message: fmt.Sprintf("not a valid color: %q", value),
+		}
+	}
+	return &color.NRGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 0xff}, nil
+}
+
 func parseSize(sizeValue string, size *Size) error {
 	switch sizeValue {
 	case SizeStringFull, "":
@@ -361,6 +632,46 @@ func parseSize(sizeValue string, size *Size) error {
 	return err
 }
 
+// parseSize3 parses a size in IIIF Image API 3.0 syntax, which differs
+// from 2.1 by not having "full", and by forbidding upscaling unless the
+// size is prefixed with "^".
+func parseSize3(sizeValue string, size *Size) error {
+	size.Upscaling = UpscalingForbidden
+	value := sizeValue
+	if strings.HasPrefix(value, SizeStringUpscale) {
+		size.Upscaling = UpscalingRequested
+		value = value[len(SizeStringUpscale):]
+	}
+
+	switch value {
+	case SizeStringFull, "":
+		return InvalidSpec{
+			Message: fmt.Sprintf("Not a valid size: %s", sizeValue),
+		}
+	case SizeStringMax:
+		size.Kind = SizeKindMax
+		return nil
+	}
+
+	if strings.HasPrefix(value, SizeStringPct) {
+		pcnt, err := strconv.ParseFloat(value[len(SizeStringPct):], 64)
+		if err != nil || pcnt < 0 || (pcnt > 100 && size.Upscaling != UpscalingRequested) {
+			return InvalidSpec{
+				Message: fmt.Sprintf("Invalid percentage number: %s", value[len(SizeStringPct):]),
+			}
+		}
+		pcnt /= 100
+		size.Kind = SizeKindRelative
+		size.Relative = &pcnt
+		return nil
+	}
+
+	var err error
+	size.Kind = SizeKindAbsolute
+	size.AbsWidth, size.AbsHeight, size.AbsBestFit, err = parseWidthHeight(value)
+	return err
+}
+
 func round(f float64) int {
 	return int(math.Floor(f + .5))
 }
@@ -373,12 +684,27 @@ func formatCompactFloat(f float64) string {
 	return strings.TrimSuffix(s, ".")
 }
 
+// supportedFormats lists the output formats, in order of preference.
+var supportedFormats = []Format{
+	FormatJPEG, FormatPNG, FormatGIF, FormatWebP, FormatTIFF, FormatBMP}
+
 var formatNameMap map[string]Format
 
+var tiffCompressionNameMap map[string]imageops.TIFFCompression
+
 func init() {
-	formats := []Format{FormatJPEG, FormatPNG, FormatGIF}
-	formatNameMap = make(map[string]Format, len(formats))
-	for _, n := range formats {
+	formatNameMap = make(map[string]Format, len(supportedFormats))
+	for _, n := range supportedFormats {
 		formatNameMap[string(n)] = n
 	}
+
+	compressions := []imageops.TIFFCompression{
+		imageops.TIFFCompressionDeflate,
+		imageops.TIFFCompressionLZW,
+		imageops.TIFFCompressionNone,
+	}
+	tiffCompressionNameMap = make(map[string]imageops.TIFFCompression, len(compressions))
+	for _, c := range compressions {
+		tiffCompressionNameMap[c.String()] = c
+	}
 }
@@ -3,6 +3,7 @@ package iiif_test
 import (
 	"fmt"
 	"image"
+	"image/color"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -103,6 +104,64 @@ func TestRequest_String(t *testing.T) {
 		})
 	})
 
+	t.Run("rotation", func(t *testing.T) {
+		t.Run("none", func(t *testing.T) {
+			req := baseRequest
+			req.Rotation = iiif.Rotation{}
+			assert.Equal(t, "http%3A%2F%2Fi.imgur.com%2FJ1XaOIa.jpg/full/max/default.png", req.String())
+		})
+		t.Run("90", func(t *testing.T) {
+			req := baseRequest
+			req.Rotation = iiif.Rotation{Degrees: 90}
+			assert.Equal(t, "http%3A%2F%2Fi.imgur.com%2FJ1XaOIa.jpg/full/max/90/default.png", req.String())
+		})
+		t.Run("mirrored", func(t *testing.T) {
+			req := baseRequest
+			req.Rotation = iiif.Rotation{Mirror: true}
+			assert.Equal(t, "http%3A%2F%2Fi.imgur.com%2FJ1XaOIa.jpg/full/max/!0/default.png", req.String())
+		})
+		t.Run("arbitrary", func(t *testing.T) {
+			req := baseRequest
+			req.Rotation = iiif.Rotation{Degrees: 22.5}
+			assert.Equal(t, "http%3A%2F%2Fi.imgur.com%2FJ1XaOIa.jpg/full/max/22.5/default.png", req.String())
+		})
+		t.Run("mirrored 270", func(t *testing.T) {
+			req := baseRequest
+			req.Rotation = iiif.Rotation{Degrees: 270, Mirror: true}
+			assert.Equal(t, "http%3A%2F%2Fi.imgur.com%2FJ1XaOIa.jpg/full/max/!270/default.png", req.String())
+		})
+	})
+
+	t.Run("quality", func(t *testing.T) {
+		t.Run("default", func(t *testing.T) {
+			req := baseRequest
+			req.Quality = iiif.QualityDefault
+			assert.Equal(t, "http%3A%2F%2Fi.imgur.com%2FJ1XaOIa.jpg/full/max/default.png", req.String())
+		})
+		t.Run("gray", func(t *testing.T) {
+			req := baseRequest
+			req.Quality = iiif.QualityGray
+			assert.Equal(t, "http%3A%2F%2Fi.imgur.com%2FJ1XaOIa.jpg/full/max/gray.png", req.String())
+		})
+		t.Run("bitonal", func(t *testing.T) {
+			req := baseRequest
+			req.Quality = iiif.QualityBitonal
+			assert.Equal(t, "http%3A%2F%2Fi.imgur.com%2FJ1XaOIa.jpg/full/max/bitonal.png", req.String())
+		})
+		t.Run("bitonal, dithered", func(t *testing.T) {
+			req := baseRequest
+			req.Quality = iiif.QualityBitonal
+			req.Dither = true
+			assert.Equal(t, "http%3A%2F%2Fi.imgur.com%2FJ1XaOIa.jpg/full/max/bitonal.png?dither=true", req.String())
+		})
+		t.Run("gray, dithered", func(t *testing.T) {
+			req := baseRequest
+			req.Quality = iiif.QualityGray
+			req.Dither = true
+			assert.Equal(t, "http%3A%2F%2Fi.imgur.com%2FJ1XaOIa.jpg/full/max/gray.png", req.String())
+		})
+	})
+
 	t.Run("format", func(t *testing.T) {
 		t.Run("png", func(t *testing.T) {
 			req := baseRequest
@@ -119,6 +178,52 @@ func TestRequest_String(t *testing.T) {
 			req.Format = iiif.FormatGIF
 			assert.Equal(t, "http%3A%2F%2Fi.imgur.com%2FJ1XaOIa.jpg/full/max/default.gif", req.String())
 		})
+		t.Run("webp", func(t *testing.T) {
+			req := baseRequest
+			req.Format = iiif.FormatWebP
+			assert.Equal(t, "http%3A%2F%2Fi.imgur.com%2FJ1XaOIa.jpg/full/max/default.webp", req.String())
+		})
+		t.Run("tif", func(t *testing.T) {
+			req := baseRequest
+			req.Format = iiif.FormatTIFF
+			assert.Equal(t, "http%3A%2F%2Fi.imgur.com%2FJ1XaOIa.jpg/full/max/default.tif", req.String())
+		})
+		t.Run("tif, lzw", func(t *testing.T) {
+			req := baseRequest
+			req.Format = iiif.FormatTIFF
+			req.TIFFCompression = imageops.TIFFCompressionLZW
+			assert.Equal(t, "http%3A%2F%2Fi.imgur.com%2FJ1XaOIa.jpg/full/max/default.tif?tiffCompression=lzw", req.String())
+		})
+		t.Run("bmp", func(t *testing.T) {
+			req := baseRequest
+			req.Format = iiif.FormatBMP
+			assert.Equal(t, "http%3A%2F%2Fi.imgur.com%2FJ1XaOIa.jpg/full/max/default.bmp", req.String())
+		})
+		t.Run("webp, lossless", func(t *testing.T) {
+			req := baseRequest
+			req.Format = iiif.FormatWebP
+			req.WebPLossless = true
+			assert.Equal(t, "http%3A%2F%2Fi.imgur.com%2FJ1XaOIa.jpg/full/max/default.webp?webpLossless=true", req.String())
+		})
+		t.Run("webp, quality", func(t *testing.T) {
+			req := baseRequest
+			req.Format = iiif.FormatWebP
+			req.WebPQuality = 82.5
+			assert.Equal(t, "http%3A%2F%2Fi.imgur.com%2FJ1XaOIa.jpg/full/max/default.webp?webpQuality=82.5", req.String())
+		})
+		t.Run("png, webp options", func(t *testing.T) {
+			req := baseRequest
+			req.Format = iiif.FormatPNG
+			req.WebPLossless = true
+			req.WebPQuality = 82.5
+			assert.Equal(t, "http%3A%2F%2Fi.imgur.com%2FJ1XaOIa.jpg/full/max/default.png", req.String())
+		})
+		t.Run("png, tif options", func(t *testing.T) {
+			req := baseRequest
+			req.Format = iiif.FormatPNG
+			req.TIFFCompression = imageops.TIFFCompressionLZW
+			assert.Equal(t, "http%3A%2F%2Fi.imgur.com%2FJ1XaOIa.jpg/full/max/default.png", req.String())
+		})
 	})
 
 	t.Run("autoOrient", func(t *testing.T) {
@@ -148,6 +253,31 @@ func TestRequest_String(t *testing.T) {
 		})
 	})
 
+	t.Run("background", func(t *testing.T) {
+		t.Run("set", func(t *testing.T) {
+			req := baseRequest
+			req.Format = iiif.FormatJPEG
+			req.Background = &color.NRGBA{R: 0xff, G: 0x80, B: 0x01, A: 0xff}
+			assert.Equal(t, "http%3A%2F%2Fi.imgur.com%2FJ1XaOIa.jpg/full/max/default.jpg?background=ff8001", req.String())
+		})
+		t.Run("set for BMP", func(t *testing.T) {
+			req := baseRequest
+			req.Format = iiif.FormatBMP
+			req.Background = &color.NRGBA{R: 0xff, G: 0x80, B: 0x01, A: 0xff}
+			assert.Equal(t, "http%3A%2F%2Fi.imgur.com%2FJ1XaOIa.jpg/full/max/default.bmp?background=ff8001", req.String())
+		})
+		t.Run("set for a format with alpha", func(t *testing.T) {
+			req := baseRequest
+			req.Background = &color.NRGBA{R: 0xff, G: 0x80, B: 0x01, A: 0xff}
+			assert.Equal(t, "http%3A%2F%2Fi.imgur.com%2FJ1XaOIa.jpg/full/max/default.png", req.String())
+		})
+		t.Run("unset", func(t *testing.T) {
+			req := baseRequest
+			req.Background = nil
+			assert.Equal(t, "http%3A%2F%2Fi.imgur.com%2FJ1XaOIa.jpg/full/max/default.png", req.String())
+		})
+	})
+
 	t.Run("scale=down", func(t *testing.T) {
 		t.Run("true", func(t *testing.T) {
 			req := baseRequest
@@ -179,14 +309,49 @@ func TestParseSpec_invalid(t *testing.T) {
 }
 
 func TestParseSpec_rotation(t *testing.T) {
-	var err error
-
-	_, err = iiif.ParseSpec("some-identifier/full/max/0/default.png")
-	assert.NoError(t, err)
+	for _, test := range []struct {
+		rotation     string
+		expectResult iiif.Rotation
+	}{
+		{rotation: "0", expectResult: iiif.Rotation{Degrees: 0}},
+		{rotation: "90", expectResult: iiif.Rotation{Degrees: 90}},
+		{rotation: "180", expectResult: iiif.Rotation{Degrees: 180}},
+		{rotation: "270", expectResult: iiif.Rotation{Degrees: 270}},
+		{rotation: "!0", expectResult: iiif.Rotation{Degrees: 0, Mirror: true}},
+		{rotation: "!90", expectResult: iiif.Rotation{Degrees: 90, Mirror: true}},
+		{rotation: "!180", expectResult: iiif.Rotation{Degrees: 180, Mirror: true}},
+		{rotation: "!270", expectResult: iiif.Rotation{Degrees: 270, Mirror: true}},
+		{rotation: "22.5", expectResult: iiif.Rotation{Degrees: 22.5}},
+		{rotation: "!22.5", expectResult: iiif.Rotation{Degrees: 22.5, Mirror: true}},
+		{rotation: "1", expectResult: iiif.Rotation{Degrees: 1}},
+		{rotation: "359.99", expectResult: iiif.Rotation{Degrees: 359.99}},
+		{rotation: "360", expectResult: iiif.Rotation{Degrees: 360}},
+	} {
+		t.Run(test.rotation, func(t *testing.T) {
+			req, err := iiif.ParseSpec(
+				fmt.Sprintf("some-identifier/full/max/%s/default.png", test.rotation))
+			if assert.NoError(t, err) {
+				assert.Equal(t, test.expectResult, req.Rotation)
+			}
+		})
+	}
 
-	for i := 1; i <= 360; i++ {
-		_, err = iiif.ParseSpec(fmt.Sprintf("some-identifier/full/max/%d/default.png", i))
-		assert.Error(t, err)
+	for _, test := range []struct {
+		rotation    string
+		expectError string
+	}{
+		{rotation: "!!90", expectError: `unsupported rotation "!!90"`},
+		{rotation: "-90", expectError: `unsupported rotation "-90"`},
+		{rotation: "1e2", expectError: `unsupported rotation "1e2"`},
+		{rotation: "90.", expectError: `unsupported rotation "90."`},
+		{rotation: "abc", expectError: `unsupported rotation "abc"`},
+		{rotation: "360.5", expectError: "value outside of range 0.000000..360.000000: 360.500000"},
+	} {
+		t.Run(test.rotation, func(t *testing.T) {
+			_, err := iiif.ParseSpec(
+				fmt.Sprintf("some-identifier/full/max/%s/default.png", test.rotation))
+			assert.EqualError(t, err, test.expectError)
+		})
 	}
 }
 
@@ -196,11 +361,26 @@ func TestParseSpec_quality(t *testing.T) {
 	_, err = iiif.ParseSpec("some-identifier/full/max/0/default.png")
 	assert.NoError(t, err)
 
-	_, err = iiif.ParseSpec("some-identifier/full/max/0/color.png")
-	assert.NoError(t, err)
+	for _, test := range []struct {
+		quality       string
+		expectQuality iiif.Quality
+	}{
+		{quality: "default", expectQuality: iiif.QualityDefault},
+		{quality: "color", expectQuality: iiif.QualityDefault},
+		{quality: "gray", expectQuality: iiif.QualityGray},
+		{quality: "bitonal", expectQuality: iiif.QualityBitonal},
+	} {
+		t.Run(test.quality, func(t *testing.T) {
+			req, err := iiif.ParseSpec(
+				fmt.Sprintf("some-identifier/full/max/0/%s.png", test.quality))
+			if assert.NoError(t, err) {
+				assert.Equal(t, test.expectQuality, req.Quality)
+			}
+		})
+	}
 
 	_, err = iiif.ParseSpec("some-identifier/full/max/0/grayscale.png")
-	assert.Error(t, err)
+	assert.EqualError(t, err, `unsupported quality "grayscale"`)
 }
 
 func TestParseSpec_format(t *testing.T) {
@@ -212,11 +392,14 @@ func TestParseSpec_format(t *testing.T) {
 		{format: "png", expectFormat: iiif.FormatPNG},
 		{format: "jpg", expectFormat: iiif.FormatJPEG},
 		{format: "gif", expectFormat: iiif.FormatGIF},
+		{format: "webp", expectFormat: iiif.FormatWebP},
+		{format: "tif", expectFormat: iiif.FormatTIFF},
+		{format: "bmp", expectFormat: iiif.FormatBMP},
+		{format: "tiff", expectError: "unsupported format \"tiff\""},
 		{format: "", expectError: `not a valid spec: "some-identifier/full/max/0/default."`},
-		{format: "tif", expectError: "unsupported format \"tif\""},
 		{format: "jp2", expectError: "unsupported format \"jp2\""},
 		{format: "pdf", expectError: "unsupported format \"pdf\""},
-		{format: "webp", expectError: "unsupported format \"webp\""},
+
 		{format: "a4", expectError: "unsupported format \"a4\""},
 	} {
 		t.Run(test.format, func(t *testing.T) {
@@ -485,6 +668,79 @@ func TestParseSpec(t *testing.T) {
 				Format:     iiif.FormatPNG,
 			},
 		},
+		{
+			in: "identifier/full/max/!90/default.png",
+			expected: &iiif.Request{
+				Identifier: "identifier",
+				Region:     iiif.Region{Kind: iiif.RegionKindFull},
+				Size:       iiif.Size{Kind: iiif.SizeKindMax},
+				Rotation:   iiif.Rotation{Degrees: 90, Mirror: true},
+				Format:     iiif.FormatPNG,
+			},
+		},
+		{
+			in: "identifier/full/max/22.5/default.jpg?background=FFffFF",
+			expected: &iiif.Request{
+				Identifier: "identifier",
+				Region:     iiif.Region{Kind: iiif.RegionKindFull},
+				Size:       iiif.Size{Kind: iiif.SizeKindMax},
+				Rotation:   iiif.Rotation{Degrees: 22.5},
+				Format:     iiif.FormatJPEG,
+				Background: &color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff},
+			},
+		},
+		{
+			in: "identifier/full/max/0/bitonal.gif?dither=true",
+			expected: &iiif.Request{
+				Identifier: "identifier",
+				Region:     iiif.Region{Kind: iiif.RegionKindFull},
+				Size:       iiif.Size{Kind: iiif.SizeKindMax},
+				Quality:    iiif.QualityBitonal,
+				Format:     iiif.FormatGIF,
+				Dither:     true,
+			},
+		},
+		{
+			in:            "identifier/full/max/0/bitonal.gif?dither=maybe",
+			expectedError: `not a boolean value: "maybe"`,
+		},
+		{
+			in: "identifier/full/max/0/default.webp?webpLossless=true&webpQuality=90",
+			expected: &iiif.Request{
+				Identifier:   "identifier",
+				Region:       iiif.Region{Kind: iiif.RegionKindFull},
+				Size:         iiif.Size{Kind: iiif.SizeKindMax},
+				Format:       iiif.FormatWebP,
+				WebPLossless: true,
+				WebPQuality:  90,
+			},
+		},
+		{
+			in: "identifier/full/max/0/default.tif?tiffCompression=none",
+			expected: &iiif.Request{
+				Identifier:      "identifier",
+				Region:          iiif.Region{Kind: iiif.RegionKindFull},
+				Size:            iiif.Size{Kind: iiif.SizeKindMax},
+				Format:          iiif.FormatTIFF,
+				TIFFCompression: imageops.TIFFCompressionNone,
+			},
+		},
+		{
+			in:            "identifier/full/max/0/default.tif?tiffCompression=jpeg",
+			expectedError: `unsupported TIFF compression "jpeg"`,
+		},
+		{
+			in:            "identifier/full/max/0/default.webp?webpQuality=0",
+			expectedError: "value outside of range 1.000000..100.000000: 0.000000",
+		},
+		{
+			in:            "identifier/full/max/0/default.png?background=fff",
+			expectedError: `not a valid color: "fff"`,
+		},
+		{
+			in:            "identifier/full/max/0/default.png?background=gggggg",
+			expectedError: `not a valid color: "gggggg"`,
+		},
 		{
 			in:            "identifier/full/max/0/default.png?scale=invalid",
 			expectedError: `not a valid scale: "invalid"`,
@@ -514,6 +770,27 @@ func TestParseSpec(t *testing.T) {
 	}
 }
 
+func TestParseSpec_unusedOptions(t *testing.T) {
+	for _, test := range []struct {
+		in       string
+		expected string
+	}{
+		{"x/full/max/0/gray.png?dither=true", "x/full/max/gray.png"},
+		{"x/full/max/0/bitonal.png?dither=true", "x/full/max/bitonal.png?dither=true"},
+		{"x/full/max/0/default.jpg?webpQuality=10&webpLossless=true", "x/full/max/default.jpg"},
+		{"x/full/max/0/default.webp?webpQuality=10", "x/full/max/default.webp?webpQuality=10"},
+		{"x/full/max/0/default.jpg?tiffCompression=lzw", "x/full/max/default.jpg"},
+		{"x/full/max/0/default.tif?webpQuality=10&tiffCompression=lzw", "x/full/max/default.tif?tiffCompression=lzw"},
+	} {
+		t.Run(test.in, func(t *testing.T) {
+			req, err := iiif.ParseSpec(test.in)
+			if assert.NoError(t, err) {
+				assert.Equal(t, test.expected, req.String())
+			}
+		})
+	}
+}
+
 func TestSize_CalculateDimensions(t *testing.T) {
 	type scenario struct {
 		description   string
@@ -1095,6 +1372,157 @@ func TestSize_CalculateDimensions(t *testing.T) {
 	}
 }
 
+func TestParseVersionedSpec_size3(t *testing.T) {
+	for _, test := range []struct {
+		size         string
+		expectResult iiif.Size
+		expectError  string
+	}{
+		{
+			size:         "max",
+			expectResult: iiif.Size{Kind: iiif.SizeKindMax, Upscaling: iiif.UpscalingForbidden},
+		},
+		{
+			size:         "^max",
+			expectResult: iiif.Size{Kind: iiif.SizeKindMax, Upscaling: iiif.UpscalingRequested},
+		},
+		{
+			size: "100,",
+			expectResult: iiif.Size{Kind: iiif.SizeKindAbsolute, AbsWidth: newInt(100),
+				Upscaling: iiif.UpscalingForbidden},
+		},
+		{
+			size: "^,200",
+			expectResult: iiif.Size{Kind: iiif.SizeKindAbsolute, AbsHeight: newInt(200),
+				Upscaling: iiif.UpscalingRequested},
+		},
+		{
+			size: "^!100,200",
+			expectResult: iiif.Size{Kind: iiif.SizeKindAbsolute, AbsWidth: newInt(100), AbsHeight: newInt(200),
+				AbsBestFit: true, Upscaling: iiif.UpscalingRequested},
+		},
+		{
+			size: "pct:50",
+			expectResult: iiif.Size{Kind: iiif.SizeKindRelative, Relative: newFloat64(0.5),
+				Upscaling: iiif.UpscalingForbidden},
+		},
+		{
+			size: "^pct:150",
+			expectResult: iiif.Size{Kind: iiif.SizeKindRelative, Relative: newFloat64(1.5),
+				Upscaling: iiif.UpscalingRequested},
+		},
+		{size: "pct:150", expectError: "Invalid percentage number: 150"},
+		{size: "full", expectError: "Not a valid size: full"},
+		{size: "^full", expectError: "Not a valid size: ^full"},
+		{size: "^", expectError: "Not a valid size: ^"},
+		{size: "^^max", expectError: "Not a valid width/height: ^max"},
+	} {
+		t.Run(test.size, func(t *testing.T) {
+			req, err := iiif.ParseVersionedSpec(iiif.APIVersion3,
+				fmt.Sprintf("some-identifier/full/%s/0/default.png", test.size))
+			if test.expectError != "" {
+				assert.EqualError(t, err, test.expectError)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, test.expectResult, req.Size)
+			}
+		})
+	}
+}
+
+func TestRequest_VersionedString(t *testing.T) {
+	req := iiif.Request{
+		Identifier: "http://i.imgur.com/J1XaOIa.jpg",
+		Region:     iiif.Region{Kind: iiif.RegionKindFull},
+		Size:       iiif.Size{Kind: iiif.SizeKindMax, Upscaling: iiif.UpscalingForbidden},
+		Format:     iiif.FormatPNG,
+	}
+	assert.Equal(t, "http%3A%2F%2Fi.imgur.com%2FJ1XaOIa.jpg/full/max/default.png",
+		req.VersionedString(iiif.APIVersion2))
+	assert.Equal(t, "http%3A%2F%2Fi.imgur.com%2FJ1XaOIa.jpg/full/max/0/default.png",
+		req.VersionedString(iiif.APIVersion3))
+
+	req.Size.Upscaling = iiif.UpscalingRequested
+	assert.Equal(t, "http%3A%2F%2Fi.imgur.com%2FJ1XaOIa.jpg/full/^max/0/default.png",
+		req.VersionedString(iiif.APIVersion3))
+
+	for _, spec := range []string{
+		"foo/full/^max/90/gray.jpg",
+		"foo/10,10,20,20/^!100,200/!22.5/bitonal.png?dither=true",
+		"foo/pct:10,10,20,20/pct:50/0/default.gif",
+	} {
+		parsed, err := iiif.ParseVersionedSpec(iiif.APIVersion3, spec)
+		if assert.NoError(t, err) {
+			assert.Equal(t, spec, parsed.VersionedString(iiif.APIVersion3))
+		}
+	}
+}
+
+func TestSize_CalculateDimensions_upscaling(t *testing.T) {
+	in, maxSize := image.Pt(300, 400), image.Pt(1000, 1000)
+	for _, test := range []struct {
+		description   string
+		size          iiif.Size
+		expected      image.Point
+		expectedError string
+	}{
+		{
+			description: "max, forbidden",
+			size:        iiif.Size{Kind: iiif.SizeKindMax, Upscaling: iiif.UpscalingForbidden},
+			expected:    image.Pt(300, 400),
+		},
+		{
+			description: "max, requested",
+			size:        iiif.Size{Kind: iiif.SizeKindMax, Upscaling: iiif.UpscalingRequested},
+			expected:    image.Pt(750, 1000),
+		},
+		{
+			description:   "width, forbidden",
+			size:          iiif.Size{Kind: iiif.SizeKindAbsolute, AbsWidth: newInt(600), Upscaling: iiif.UpscalingForbidden},
+			expectedError: `(600, 800) exceeds region dimensions (300, 400) without "^"`,
+		},
+		{
+			description: "width, requested",
+			size:        iiif.Size{Kind: iiif.SizeKindAbsolute, AbsWidth: newInt(600), Upscaling: iiif.UpscalingRequested},
+			expected:    image.Pt(600, 800),
+		},
+		{
+			description: "width, smaller, forbidden",
+			size:        iiif.Size{Kind: iiif.SizeKindAbsolute, AbsWidth: newInt(150), Upscaling: iiif.UpscalingForbidden},
+			expected:    image.Pt(150, 200),
+		},
+		{
+			description: "best fit, forbidden",
+			size: iiif.Size{Kind: iiif.SizeKindAbsolute, AbsWidth: newInt(600), AbsHeight: newInt(600),
+				AbsBestFit: true, Upscaling: iiif.UpscalingForbidden},
+			expected: image.Pt(300, 400),
+		},
+		{
+			description: "best fit, requested",
+			size: iiif.Size{Kind: iiif.SizeKindAbsolute, AbsWidth: newInt(600), AbsHeight: newInt(600),
+				AbsBestFit: true, Upscaling: iiif.UpscalingRequested},
+			expected: image.Pt(450, 600),
+		},
+		{
+			description:   "percentage, requested, too large",
+			size:          iiif.Size{Kind: iiif.SizeKindRelative, Relative: newFloat64(3), Upscaling: iiif.UpscalingRequested},
+			expectedError: "(900, 1200) exceeds maximum allowed dimensions (1000, 1000)",
+		},
+	} {
+		t.Run(test.description, func(t *testing.T) {
+			actual, err := test.size.CalculateDimensions(in, maxSize)
+			if test.expectedError != "" {
+				assert.EqualError(t, err, test.expectedError)
+				assert.IsType(t, iiif.InvalidSpec{}, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, actual)
+		})
+	}
+}
+
 func newFloat64(v float64) *float64 {
 	return &v
 }
@@ -0,0 +1,87 @@
+package iiif
+
+import (
+	"image"
+	"sort"
+)
+
+// Tiling describes the tiles that clients are encouraged to request, as
+// described in http://iiif.io/api/image/2.1/#tiles. Regions requested at
+// one of the scale factors are rendered from a cached, pre-scaled copy of
+// the image.
+type Tiling struct {
+	// Width is the width and height of a tile, in pixels of the scaled
+	// image.
+	Width int
+
+	// ScaleFactors lists the factors by which the full image may be
+	// scaled down, such as 1, 2, 4 and 8.
+	ScaleFactors []int
+}
+
+// DefaultTiling is a tiling suitable for common deep-zoom viewers.
+var DefaultTiling = Tiling{
+	Width:        512,
+	ScaleFactors: []int{1, 2, 4, 8, 16, 32},
+}
+
+// Enabled returns whether tiles are advertised.
+func (t Tiling) Enabled() bool {
+	return t.Width > 0 && len(t.ScaleFactors) > 0
+}
+
+// Sizes returns the preferred sizes of thumbnails of a full image of the
+// given size, from smallest to largest. These are the sizes of the image
+// at each of the scale factors other than 1.
+func (t Tiling) Sizes(full image.Point) []image.Point {
+	factors := append([]int(nil), t.ScaleFactors...)
+	sort.Sort(sort.Reverse(sort.IntSlice(factors)))
+
+	var sizes []image.Point
+	for _, s := range factors {
+		if s <= 1 {
+			continue
+		}
+		size := scaledSize(full, s)
+		if size.X < 1 || size.Y < 1 || size.X > maxScaleSize.X || size.Y > maxScaleSize.Y {
+			continue
+		}
+		if len(sizes) > 0 && sizes[len(sizes)-1] == size {
+			continue
+		}
+		sizes = append(sizes, size)
+	}
+	return sizes
+}
+
+// scaleFactor returns the scale factor at which a region of the full image,
+// scaled to the given size, can be cut out of the image scaled by that
+// factor. It returns false if there is none.
+func (t Tiling) scaleFactor(region image.Rectangle, size image.Point) (int, bool) {
+	if region.Empty() {
+		return 0, false
+	}
+	for _, s := range t.ScaleFactors {
+		if s < 1 || region.Min.X%s != 0 || region.Min.Y%s != 0 {
+			continue
+		}
+		// Edge tiles may be rounded either way
+		if abs(size.X*s-region.Dx()) < s && abs(size.Y*s-region.Dy()) < s {
+			return s, true
+		}
+	}
+	return 0, false
+}
+
+// scaledSize returns the size of an image scaled down by a factor,
+// rounding up.
+func scaledSize(size image.Point, factor int) image.Point {
+	return image.Pt((size.X+factor-1)/factor, (size.Y+factor-1)/factor)
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
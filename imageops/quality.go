@@ -0,0 +1,49 @@
+package imageops
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+
+	"github.com/disintegration/imaging"
+)
+
+// Grayscale converts an image to shades of gray by luminance. Opaque images
+// become single-channel images; otherwise transparency is preserved.
+func Grayscale(img image.Image) image.Image {
+	if !isOpaque(img) {
+		return imaging.Grayscale(img)
+	}
+	bounds := img.Bounds()
+	gray := image.NewGray(bounds)
+	draw.Draw(gray, bounds, img, bounds.Min, draw.Src)
+	return gray
+}
+
+// Bitonal converts an image to black and white by thresholding its
+// luminance, optionally dithering with Floyd-Steinberg error diffusion.
+// Transparent areas are treated as white. The result has a two-color
+// palette, so that encoders can use one bit per pixel.
+func Bitonal(img image.Image, dither bool) *image.Paletted {
+	bounds := img.Bounds()
+	gray := image.NewGray(bounds)
+	draw.Draw(gray, bounds, image.NewUniform(color.White), image.ZP, draw.Src)
+	draw.Draw(gray, bounds, img, bounds.Min, draw.Over)
+
+	bitonal := image.NewPaletted(bounds, bitonalPalette)
+	if dither {
+		draw.FloydSteinberg.Draw(bitonal, bounds, gray, bounds.Min)
+	} else {
+		draw.Draw(bitonal, bounds, gray, bounds.Min, draw.Src)
+	}
+	return bitonal
+}
+
+var bitonalPalette = color.Palette{color.Black, color.White}
+
+func isOpaque(img image.Image) bool {
+	o, ok := img.(interface {
+		Opaque() bool
+	})
+	return ok && o.Opaque()
+}
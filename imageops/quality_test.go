@@ -0,0 +1,68 @@
+package imageops_test
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/t11e/picaxe/imageops"
+)
+
+func TestGrayscale(t *testing.T) {
+	t.Run("opaque", func(t *testing.T) {
+		img := imageops.Grayscale(loadImage("hippos.png"))
+		assert.IsType(t, &image.Gray{}, img)
+		assert.Equal(t, image.Pt(640, 480), img.Bounds().Size())
+	})
+
+	t.Run("transparent", func(t *testing.T) {
+		src := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+		src.SetNRGBA(0, 0, color.NRGBA{R: 255, A: 255})
+		img := imageops.Grayscale(src)
+
+		r, g, b, a := img.At(0, 0).RGBA()
+		assert.Equal(t, r, g)
+		assert.Equal(t, g, b)
+		assert.Equal(t, uint32(0xffff), a)
+
+		_, _, _, a = img.At(1, 0).RGBA()
+		assert.Equal(t, uint32(0), a)
+	})
+}
+
+func TestBitonal(t *testing.T) {
+	src := image.NewGray(image.Rect(0, 0, 3, 1))
+	src.SetGray(0, 0, color.Gray{Y: 10})
+	src.SetGray(1, 0, color.Gray{Y: 100})
+	src.SetGray(2, 0, color.Gray{Y: 200})
+
+	img := imageops.Bitonal(src, false)
+	assert.Len(t, img.Palette, 2)
+	assert.Equal(t, []uint8{0, 0, 1}, img.Pix)
+
+	t.Run("dithered", func(t *testing.T) {
+		src := image.NewGray(image.Rect(0, 0, 16, 16))
+		for i := range src.Pix {
+			src.Pix[i] = 128
+		}
+		img := imageops.Bitonal(src, true)
+		var white int
+		for _, p := range img.Pix {
+			white += int(p)
+		}
+		assert.InDelta(t, 128, white, 16, "about half of the pixels should be white")
+	})
+
+	t.Run("one bit per pixel", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, png.Encode(&buf, imageops.Bitonal(loadImage("hippos.png"), true)))
+
+		// The bit depth is stored in the IHDR chunk
+		assert.Equal(t, byte(1), buf.Bytes()[24])
+	})
+}
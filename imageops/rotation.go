@@ -0,0 +1,126 @@
+package imageops
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// Mirror flips an image horizontally.
+func Mirror(img image.Image) image.Image {
+	return imaging.FlipH(img)
+}
+
+// Rotate rotates an image clockwise by an arbitrary angle. The canvas is
+// enlarged to the bounding box of the rotated image, and the uncovered
+// corners are filled with the background color bg. Right angles are
+// delegated to RotateRightAngle, and so are lossless. Other angles work on
+// an NRGBA copy of the image, and stop early with the context's error if
+// ctx is canceled.
+func Rotate(ctx context.Context, img image.Image, degrees float64, bg color.Color) (image.Image, error) {
+	if math.Mod(degrees, 90) == 0 {
+		return RotateRightAngle(img, int(degrees)), nil
+	}
+
+	bounds := img.Bounds()
+	src := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+
+	sin, cos := math.Sincos(degrees * math.Pi / 180)
+	w, h := float64(bounds.Dx()), float64(bounds.Dy())
+	size := RotatedSize(bounds.Size(), degrees)
+	dw, dh := size.X, size.Y
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+
+	background := color.NRGBAModel.Convert(bg).(color.NRGBA)
+	scx, scy := w/2, h/2
+	dcx, dcy := float64(dw)/2, float64(dh)/2
+	for y := 0; y < dh; y++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		for x := 0; x < dw; x++ {
+			// Map the center of the destination pixel back into the source
+			dx, dy := float64(x)+0.5-dcx, float64(y)+0.5-dcy
+			sx := dx*cos + dy*sin + scx
+			sy := -dx*sin + dy*cos + scy
+			dst.SetNRGBA(x, y, sampleBilinear(src, sx-0.5, sy-0.5, background))
+		}
+	}
+	return dst, nil
+}
+
+// RotatedSize returns the size of the image that Rotate returns for an
+// image of the given size.
+func RotatedSize(size image.Point, degrees float64) image.Point {
+	if math.Mod(degrees, 90) == 0 {
+		if math.Mod(degrees, 180) != 0 {
+			return image.Pt(size.Y, size.X)
+		}
+		return size
+	}
+	sin, cos := math.Sincos(degrees * math.Pi / 180)
+	w, h := float64(size.X), float64(size.Y)
+	return image.Pt(
+		int(math.Ceil(math.Abs(w*cos)+math.Abs(h*sin)-1e-6)),
+		int(math.Ceil(math.Abs(w*sin)+math.Abs(h*cos)-1e-6)))
+}
+
+// RotateRightAngle rotates an image clockwise by a multiple of 90 degrees.
+func RotateRightAngle(img image.Image, degrees int) image.Image {
+	switch (degrees%360 + 360) % 360 {
+	case 0:
+		return img
+	case 90:
+		return imaging.Rotate270(img)
+	case 180:
+		return imaging.Rotate180(img)
+	case 270:
+		return imaging.Rotate90(img)
+	}
+	panic(fmt.Sprintf("not a right angle: %d", degrees))
+}
+
+// sampleBilinear interpolates the color at a fractional position, treating
+// everything outside the image as background. Colors are weighted by their
+// alpha so that transparent backgrounds don't darken the edges.
+func sampleBilinear(img *image.NRGBA, x, y float64, bg color.NRGBA) color.NRGBA {
+	x0, y0 := math.Floor(x), math.Floor(y)
+	fx, fy := x-x0, y-y0
+	ix, iy := int(x0), int(y0)
+
+	var r, g, b, a float64
+	for _, s := range [4]struct {
+		x, y   int
+		weight float64
+	}{
+		{ix, iy, (1 - fx) * (1 - fy)},
+		{ix + 1, iy, fx * (1 - fy)},
+		{ix, iy + 1, (1 - fx) * fy},
+		{ix + 1, iy + 1, fx * fy},
+	} {
+		c := bg
+		if image.Pt(s.x, s.y).In(img.Rect) {
+			c = img.NRGBAAt(s.x, s.y)
+		}
+		weight := s.weight * float64(c.A)
+		r += float64(c.R) * weight
+		g += float64(c.G) * weight
+		b += float64(c.B) * weight
+		a += weight
+	}
+	if a == 0 {
+		return color.NRGBA{}
+	}
+	return color.NRGBA{
+		R: uint8(r/a + .5),
+		G: uint8(g/a + .5),
+		B: uint8(b/a + .5),
+		A: uint8(a + .5),
+	}
+}
@@ -0,0 +1,117 @@
+package imageops_test
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/t11e/picaxe/imageops"
+)
+
+func TestMirror(t *testing.T) {
+	img := imageops.Mirror(newMarkedImage())
+	assert.Equal(t, image.Pt(4, 2), img.Bounds().Size())
+	assertMarkAt(t, img, image.Pt(3, 0))
+}
+
+func TestRotateRightAngle(t *testing.T) {
+	for _, test := range []struct {
+		degrees    int
+		expectSize image.Point
+		expectMark image.Point
+	}{
+		{degrees: 0, expectSize: image.Pt(4, 2), expectMark: image.Pt(0, 0)},
+		{degrees: 90, expectSize: image.Pt(2, 4), expectMark: image.Pt(1, 0)},
+		{degrees: 180, expectSize: image.Pt(4, 2), expectMark: image.Pt(3, 1)},
+		{degrees: 270, expectSize: image.Pt(2, 4), expectMark: image.Pt(0, 3)},
+		{degrees: 360, expectSize: image.Pt(4, 2), expectMark: image.Pt(0, 0)},
+		{degrees: -90, expectSize: image.Pt(2, 4), expectMark: image.Pt(0, 3)},
+	} {
+		img := imageops.RotateRightAngle(newMarkedImage(), test.degrees)
+		assert.Equal(t, test.expectSize, img.Bounds().Size(), "size at %d", test.degrees)
+		assertMarkAt(t, img, test.expectMark)
+	}
+
+	assert.Panics(t, func() {
+		imageops.RotateRightAngle(newMarkedImage(), 45)
+	})
+}
+
+func TestRotate(t *testing.T) {
+	t.Run("right angle", func(t *testing.T) {
+		img, err := imageops.Rotate(context.Background(), newMarkedImage(), 90, color.Transparent)
+		require.NoError(t, err)
+		assert.Equal(t, image.Pt(2, 4), img.Bounds().Size())
+		assertMarkAt(t, img, image.Pt(1, 0))
+	})
+
+	t.Run("45 degrees", func(t *testing.T) {
+		src := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+		draw.Draw(src, src.Bounds(), image.NewUniform(color.White), image.ZP, draw.Src)
+
+		img, err := imageops.Rotate(context.Background(), src, 45, color.Transparent)
+		require.NoError(t, err)
+		assert.Equal(t, image.Pt(15, 15), img.Bounds().Size())
+		assert.Equal(t, color.NRGBA{}, color.NRGBAModel.Convert(img.At(0, 0)))
+		assert.Equal(t, color.NRGBA{R: 255, G: 255, B: 255, A: 255}, color.NRGBAModel.Convert(img.At(7, 7)))
+	})
+
+	t.Run("background", func(t *testing.T) {
+		src := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+		draw.Draw(src, src.Bounds(), image.NewUniform(color.White), image.ZP, draw.Src)
+
+		bg := color.NRGBA{R: 255, A: 255}
+		img, err := imageops.Rotate(context.Background(), src, 30, bg)
+		require.NoError(t, err)
+		assert.Equal(t, image.Pt(14, 14), img.Bounds().Size())
+		assert.Equal(t, bg, color.NRGBAModel.Convert(img.At(0, 0)))
+		assert.Equal(t, bg, color.NRGBAModel.Convert(img.At(13, 13)))
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := imageops.Rotate(ctx, image.NewNRGBA(image.Rect(0, 0, 10, 10)), 30, color.Transparent)
+		assert.Equal(t, context.Canceled, err)
+	})
+}
+
+func TestRotatedSize(t *testing.T) {
+	for _, test := range []struct {
+		degrees    float64
+		expectSize image.Point
+	}{
+		{degrees: 0, expectSize: image.Pt(4, 2)},
+		{degrees: 90, expectSize: image.Pt(2, 4)},
+		{degrees: 180, expectSize: image.Pt(4, 2)},
+		{degrees: -90, expectSize: image.Pt(2, 4)},
+		{degrees: 45, expectSize: image.Pt(5, 5)},
+	} {
+		assert.Equal(t, test.expectSize, imageops.RotatedSize(image.Pt(4, 2), test.degrees),
+			"size at %v", test.degrees)
+	}
+}
+
+var markColor = color.NRGBA{R: 255, A: 255}
+
+// newMarkedImage returns a 4x2 image with a mark in the top left corner.
+func newMarkedImage() image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 2))
+	img.Set(0, 0, markColor)
+	return img
+}
+
+func assertMarkAt(t *testing.T, img image.Image, pt image.Point) {
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, _, _, _ := img.At(x, y).RGBA()
+			assert.Equal(t, image.Pt(x, y) == pt, r == 0xffff, "pixel at (%d, %d)", x, y)
+		}
+	}
+}
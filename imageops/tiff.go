@@ -0,0 +1,229 @@
+package imageops
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+
+	"golang.org/x/image/tiff"
+)
+
+type TIFFCompression int
+
+const (
+	TIFFCompressionDeflate TIFFCompression = iota
+	TIFFCompressionLZW
+	TIFFCompressionNone
+)
+
+func (c TIFFCompression) String() string {
+	switch c {
+	case TIFFCompressionDeflate:
+		return "deflate"
+	case TIFFCompressionLZW:
+		return "lzw"
+	case TIFFCompressionNone:
+		return "none"
+	}
+	return fmt.Sprintf("TIFFCompression(%d)", int(c))
+}
+
+// EncodeTIFF writes an image as a TIFF file with the given compression.
+func EncodeTIFF(w io.Writer, img image.Image, compression TIFFCompression) error {
+	switch compression {
+	case TIFFCompressionDeflate:
+		return tiff.Encode(w, img, &tiff.Options{Compression: tiff.Deflate})
+	case TIFFCompressionNone:
+		return tiff.Encode(w, img, &tiff.Options{Compression: tiff.Uncompressed})
+	case TIFFCompressionLZW:
+		// The tiff package can read LZW, but not write it
+		return encodeTIFFLZW(w, img)
+	}
+	return fmt.Errorf("unsupported TIFF compression %d", compression)
+}
+
+// encodeTIFFLZW writes a baseline TIFF file consisting of a single
+// LZW-compressed strip. Grayscale images are written with one sample per
+// pixel, everything else as RGB with unassociated alpha.
+func encodeTIFFLZW(w io.Writer, img image.Image) error {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	var pix []byte
+	var photometric uint16
+	var bitsPerSample []uint16
+	if gray, ok := img.(*image.Gray); ok {
+		photometric = tiffPhotometricBlackIsZero
+		bitsPerSample = []uint16{8}
+		pix = make([]byte, 0, width*height)
+		for y := 0; y < height; y++ {
+			offset := gray.PixOffset(bounds.Min.X, bounds.Min.Y+y)
+			pix = append(pix, gray.Pix[offset:offset+width]...)
+		}
+	} else {
+		nrgba := image.NewNRGBA(image.Rect(0, 0, width, height))
+		draw.Draw(nrgba, nrgba.Bounds(), img, bounds.Min, draw.Src)
+		photometric = tiffPhotometricRGB
+		bitsPerSample = []uint16{8, 8, 8, 8}
+		pix = nrgba.Pix
+	}
+
+	var strip bytes.Buffer
+	if err := compressTIFFLZW(&strip, pix); err != nil {
+		return err
+	}
+	stripLen := strip.Len()
+	if stripLen%2 != 0 {
+		strip.WriteByte(0) // Word-align the IFD
+	}
+
+	const headerLen = 8
+	ifdOffset := uint32(headerLen + strip.Len())
+
+	type entry struct {
+		tag, kind uint16
+		values    []uint32
+	}
+	entries := []entry{
+		{tiffTagImageWidth, tiffTypeLong, []uint32{uint32(width)}},
+		{tiffTagImageLength, tiffTypeLong, []uint32{uint32(height)}},
+		{tiffTagBitsPerSample, tiffTypeShort, nil},
+		{tiffTagCompression, tiffTypeShort, []uint32{tiffCompressionLZW}},
+		{tiffTagPhotometric, tiffTypeShort, []uint32{uint32(photometric)}},
+		{tiffTagStripOffsets, tiffTypeLong, []uint32{headerLen}},
+		{tiffTagSamplesPerPixel, tiffTypeShort, []uint32{uint32(len(bitsPerSample))}},
+		{tiffTagRowsPerStrip, tiffTypeLong, []uint32{uint32(height)}},
+		{tiffTagStripByteCounts, tiffTypeLong, []uint32{uint32(stripLen)}},
+		{tiffTagPlanarConfig, tiffTypeShort, []uint32{1}},
+	}
+	for _, b := range bitsPerSample {
+		entries[2].values = append(entries[2].values, uint32(b))
+	}
+	if len(bitsPerSample) == 4 {
+		entries = append(entries, entry{tiffTagExtraSamples, tiffTypeShort, []uint32{tiffExtraSamplesUnassociatedAlpha}})
+	}
+
+	// Values that don't fit in an entry are stored after the IFD
+	const entryLen = 12
+	extraOffset := ifdOffset + 2 + uint32(len(entries))*entryLen + 4
+	var ifd, extra bytes.Buffer
+	binary.Write(&ifd, binary.LittleEndian, uint16(len(entries)))
+	for _, e := range entries {
+		var value bytes.Buffer
+		for _, v := range e.values {
+			if e.kind == tiffTypeShort {
+				binary.Write(&value, binary.LittleEndian, uint16(v))
+			} else {
+				binary.Write(&value, binary.LittleEndian, v)
+			}
+		}
+		binary.Write(&ifd, binary.LittleEndian, e.tag)
+		binary.Write(&ifd, binary.LittleEndian, e.kind)
+		binary.Write(&ifd, binary.LittleEndian, uint32(len(e.values)))
+		if value.Len() <= 4 {
+			value.Write(make([]byte, 4-value.Len()))
+			ifd.Write(value.Bytes())
+		} else {
+			binary.Write(&ifd, binary.LittleEndian, extraOffset+uint32(extra.Len()))
+			extra.Write(value.Bytes())
+		}
+	}
+	binary.Write(&ifd, binary.LittleEndian, uint32(0)) // No next IFD
+
+	header := []byte{'I', 'I', 42, 0, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(header[4:], ifdOffset)
+	for _, b := range [][]byte{header, strip.Bytes(), ifd.Bytes(), extra.Bytes()} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compressTIFFLZW compresses data with the LZW variant used by TIFF, which
+// packs codes MSB-first and widens them one code earlier than GIF does.
+func compressTIFFLZW(w io.Writer, data []byte) error {
+	const (
+		clearCode = 256
+		eoiCode   = 257
+		firstCode = 258
+		maxCode   = 4093
+	)
+
+	bw := bufio.NewWriter(w)
+	var bits uint32
+	var nBits uint
+	emit := func(code uint32, width uint) {
+		bits |= code << (32 - width - nBits)
+		nBits += width
+		for nBits >= 8 {
+			bw.WriteByte(byte(bits >> 24))
+			bits <<= 8
+			nBits -= 8
+		}
+	}
+
+	width := uint(9)
+	next := uint32(firstCode)
+	table := make(map[uint32]uint32)
+	emit(clearCode, width)
+	if len(data) > 0 {
+		prefix := uint32(data[0])
+		for _, b := range data[1:] {
+			key := prefix<<8 | uint32(b)
+			if code, ok := table[key]; ok {
+				prefix = code
+				continue
+			}
+			emit(prefix, width)
+			table[key] = next
+			next++
+			if next > maxCode {
+				emit(clearCode, width)
+				width, next = 9, firstCode
+				table = make(map[uint32]uint32)
+			} else if next == 1<<width {
+				width++
+			}
+			prefix = uint32(b)
+		}
+		emit(prefix, width)
+		// The decoder adds an entry for the last code too, and may widen
+		if next+1 == 1<<width && width < 12 {
+			width++
+		}
+	}
+	emit(eoiCode, width)
+	if nBits > 0 {
+		bw.WriteByte(byte(bits >> 24))
+	}
+	return bw.Flush()
+}
+
+const (
+	tiffTagImageWidth      = 256
+	tiffTagImageLength     = 257
+	tiffTagBitsPerSample   = 258
+	tiffTagCompression     = 259
+	tiffTagPhotometric     = 262
+	tiffTagStripOffsets    = 273
+	tiffTagSamplesPerPixel = 277
+	tiffTagRowsPerStrip    = 278
+	tiffTagStripByteCounts = 279
+	tiffTagPlanarConfig    = 284
+	tiffTagExtraSamples    = 338
+
+	tiffTypeShort = 3
+	tiffTypeLong  = 4
+
+	tiffCompressionLZW = 5
+
+	tiffPhotometricBlackIsZero = 1
+	tiffPhotometricRGB         = 2
+
+	tiffExtraSamplesUnassociatedAlpha = 2
+)
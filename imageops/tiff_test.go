@@ -0,0 +1,118 @@
+package imageops_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/draw"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/image/tiff"
+
+	"github.com/t11e/picaxe/imageops"
+)
+
+func TestEncodeTIFF(t *testing.T) {
+	hippos := loadImage("hippos.png")
+
+	noise := image.NewNRGBA(image.Rect(0, 0, 300, 200))
+	rand.New(rand.NewSource(1)).Read(noise.Pix)
+
+	gray := image.NewGray(image.Rect(0, 0, 101, 33))
+	draw.Draw(gray, gray.Bounds(), hippos, image.ZP, draw.Src)
+
+	empty := image.NewNRGBA(image.Rect(0, 0, 0, 0))
+
+	for _, compression := range []imageops.TIFFCompression{
+		imageops.TIFFCompressionDeflate,
+		imageops.TIFFCompressionLZW,
+		imageops.TIFFCompressionNone,
+	} {
+		t.Run(compression.String(), func(t *testing.T) {
+			for name, img := range map[string]image.Image{
+				"hippos": hippos,
+				"noise":  noise,
+				"gray":   gray,
+				"empty":  empty,
+			} {
+				t.Run(name, func(t *testing.T) {
+					var buf bytes.Buffer
+					require.NoError(t, imageops.EncodeTIFF(&buf, img, compression))
+					if img.Bounds().Empty() {
+						return
+					}
+
+					decoded, err := tiff.Decode(&buf)
+					require.NoError(t, err)
+					assertSamePixels(t, img, decoded)
+				})
+			}
+		})
+	}
+}
+
+// The LZW fixtures are written by libtiff, so EncodeTIFF must write the same
+// strips for the same pixels.
+func TestEncodeTIFF_libtiff(t *testing.T) {
+	for _, name := range []string{
+		"hippos-crop-50,50,150,150-lzw.tif",
+		"hippos-crop-50,50,150,150-gray-lzw.tif",
+	} {
+		t.Run(name, func(t *testing.T) {
+			expect, err := ioutil.ReadFile("../testdata/" + name)
+			require.NoError(t, err)
+			img, err := tiff.Decode(bytes.NewReader(expect))
+			require.NoError(t, err)
+
+			var buf bytes.Buffer
+			require.NoError(t, imageops.EncodeTIFF(&buf, img, imageops.TIFFCompressionLZW))
+			assert.Equal(t, readTIFFStrip(t, expect), readTIFFStrip(t, buf.Bytes()))
+		})
+	}
+}
+
+// readTIFFStrip returns the data of a little-endian TIFF file that is
+// stored as a single strip.
+func readTIFFStrip(t *testing.T, data []byte) []byte {
+	require.Equal(t, "II", string(data[:2]))
+	ifd := data[binary.LittleEndian.Uint32(data[4:]):]
+	var offset, length uint32
+	for i := 0; i < int(binary.LittleEndian.Uint16(ifd)); i++ {
+		entry := ifd[2+12*i:]
+		value := binary.LittleEndian.Uint32(entry[8:])
+		if binary.LittleEndian.Uint16(entry[2:]) == 3 {
+			value = uint32(binary.LittleEndian.Uint16(entry[8:]))
+		}
+		switch binary.LittleEndian.Uint16(entry) {
+		case 273:
+			offset = value
+		case 279:
+			length = value
+		default:
+			continue
+		}
+		require.Equal(t, uint32(1), binary.LittleEndian.Uint32(entry[4:]), "number of strips")
+	}
+	return data[offset : offset+length]
+}
+
+func assertSamePixels(t *testing.T, expect, actual image.Image) {
+	if !assert.Equal(t, expect.Bounds().Size(), actual.Bounds().Size()) {
+		return
+	}
+	eb, ab := expect.Bounds(), actual.Bounds()
+	for y := 0; y < eb.Dy(); y++ {
+		for x := 0; x < eb.Dx(); x++ {
+			e := color.NRGBAModel.Convert(expect.At(eb.Min.X+x, eb.Min.Y+y))
+			a := color.NRGBAModel.Convert(actual.At(ab.Min.X+x, ab.Min.Y+y))
+			if e != a {
+				t.Fatalf("pixel (%d, %d) differs: expected %v, got %v", x, y, e, a)
+			}
+		}
+	}
+}
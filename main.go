@@ -6,12 +6,17 @@ import (
 	_ "image/jpeg"
 	_ "image/png"
 	"log"
+	"net/http"
 	"os"
 	"strings"
 	"time"
 
 	"github.com/jessevdk/go-flags"
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
 
+	"github.com/t11e/picaxe/derivatives"
 	"github.com/t11e/picaxe/iiif"
 	"github.com/t11e/picaxe/resources"
 	"github.com/t11e/picaxe/server"
@@ -20,6 +25,49 @@ import (
 type Options struct {
 	ListenAddress string `short:"l" long:"listen" description:"Listen address." value-name:"[HOST][:PORT]"`
 	MaxAge        string `short:"m" long:"max-age" default:"31536000s" description:"max-age for cache-control response header." value-name:"[integer][unit h,m, or s]"`
+
+	CanonicalRedirect string   `long:"canonical-redirect" choice:"permanent" choice:"temporary" description:"Redirect image requests to their canonical URI."`
+	CORSOrigins       []string `long:"cors-origin" description:"Origin allowed to make cross-origin requests, or * for any. May be repeated." value-name:"ORIGIN"`
+
+	TileWidth        int   `long:"tile-width" default:"512" description:"Width and height of advertised tiles, or 0 to disable tiling." value-name:"PIXELS"`
+	TileScaleFactors []int `long:"tile-scale-factor" default:"1" default:"2" default:"4" default:"8" default:"16" default:"32" description:"Scale factor of advertised tiles. May be repeated." value-name:"FACTOR"`
+	LevelCacheSize   int64 `long:"level-cache-size" default:"512" description:"Memory used to cache decoded images for tiles." value-name:"MEGABYTES"`
+
+	MaxImageWidth  int   `long:"max-image-width" default:"0" description:"Widest source image that is decoded, or 0 for no limit." value-name:"PIXELS"`
+	MaxImageHeight int   `long:"max-image-height" default:"0" description:"Tallest source image that is decoded, or 0 for no limit." value-name:"PIXELS"`
+	MaxImagePixels int64 `long:"max-image-pixels" default:"100000000" description:"Largest number of pixels in a source image that is decoded, or 0 for no limit." value-name:"PIXELS"`
+	MemoryBudget   int64 `long:"memory-budget" default:"0" description:"Memory used by decoded source images and rotated images across all requests, or 0 for no limit. Requests wait until enough is free." value-name:"MEGABYTES"`
+
+	Resolver    string `long:"resolver" default:"http" choice:"http" choice:"file" choice:"s3" description:"How identifiers are resolved: as HTTP(S) URLs, as paths under --file-root, or as S3 bucket/key pairs."`
+	FileRoot    string `long:"file-root" description:"Directory that file identifiers are relative to." value-name:"DIR"`
+	S3Endpoint  string `long:"s3-endpoint" description:"URL of the S3-compatible service. Defaults to AWS." value-name:"URL"`
+	S3Region    string `long:"s3-region" default:"us-east-1" description:"S3 region."`
+	S3PathStyle bool   `long:"s3-path-style" description:"Use path-style S3 URLs."`
+
+	AllowedHosts         []string `long:"allow-host" description:"Host that HTTP identifiers may be fetched from, or *.domain for its subdomains. May be repeated. Defaults to any host." value-name:"HOST"`
+	DeniedHosts          []string `long:"deny-host" description:"Host that HTTP identifiers may not be fetched from, or *.domain for its subdomains. May be repeated." value-name:"HOST"`
+	AllowPrivateNetworks bool     `long:"allow-private-networks" description:"Allow HTTP identifiers on private, loopback and link-local addresses."`
+	MaxSourceSize        int64    `long:"max-source-size" default:"10" description:"Largest source image that is downloaded over HTTP or from S3." value-name:"MEGABYTES"`
+	HTTPRetries          int      `long:"http-retries" default:"2" description:"Number of times to retry HTTP downloads that fail to connect or get status 502, 503 or 504."`
+	HTTPRetryBackoff     string   `long:"http-retry-backoff" default:"100ms" description:"Delay before the first retry, doubled for each further retry." value-name:"[integer][unit ms, s]"`
+	BreakerThreshold     int      `long:"breaker-threshold" default:"5" description:"Number of consecutive failures of a host after which HTTP downloads from it fail immediately, or 0 to disable."`
+	BreakerTimeout       string   `long:"breaker-timeout" default:"30s" description:"How long HTTP downloads from a failing host fail immediately before trying it again." value-name:"[integer][unit m, s]"`
+
+	CacheDir  string `long:"cache-dir" description:"Directory to cache source images in. Disabled if empty." value-name:"DIR"`
+	CacheSize int64  `long:"cache-size" default:"1024" description:"Maximum size of the source image cache." value-name:"MEGABYTES"`
+	CacheTTL  string `long:"cache-ttl" default:"1h" description:"How long cached source images are used before checking whether they have changed." value-name:"[integer][unit h,m, or s]"`
+
+	MaxConcurrentProcesses int    `long:"max-concurrent-processes" default:"0" description:"Maximum number of images processed at once, or 0 for no limit." value-name:"COUNT"`
+	MaxQueuedProcesses     int    `long:"max-queued-processes" default:"100" description:"Maximum number of requests waiting to be processed. Further requests get status 503." value-name:"COUNT"`
+	MaxQueueWait           string `long:"max-queue-wait" default:"10s" description:"Longest time a request waits to be processed before it gets status 503, or 0 for no limit." value-name:"[integer][unit m, s]"`
+
+	DerivativeCache     string `long:"derivative-cache" choice:"memory" choice:"disk" description:"Where to cache rendered images. Disabled if empty."`
+	DerivativeCacheDir  string `long:"derivative-cache-dir" description:"Directory of the disk derivative cache." value-name:"DIR"`
+	DerivativeCacheSize int64  `long:"derivative-cache-size" default:"256" description:"Maximum size of the derivative cache." value-name:"MEGABYTES"`
+
+	StreamThreshold int `long:"stream-threshold" default:"0" description:"Stream rendered images larger than this to clients as they are encoded, rather than buffering them, or 0 to always buffer." value-name:"KILOBYTES"`
+
+	ResolverConfig string `long:"resolver-config" description:"JSON file of resolvers to route identifiers to by prefix. Overrides --resolver." value-name:"FILE"`
 }
 
 func main() {
@@ -42,16 +90,151 @@ func main() {
 		}
 	}
 
+	var canonicalRedirectStatus int
+	switch options.CanonicalRedirect {
+	case "permanent":
+		canonicalRedirectStatus = http.StatusMovedPermanently
+	case "temporary":
+		canonicalRedirectStatus = http.StatusFound
+	}
+
+	var resolver resources.Resolver
+	switch {
+	case options.ResolverConfig != "":
+		var err error
+		if resolver, err = readResolverConfig(options.ResolverConfig); err != nil {
+			fmt.Fprintf(os.Stderr, "resolver-config %s\n", err.Error())
+			os.Exit(1)
+		}
+	case options.Resolver == "http":
+		retryBackoff, err := time.ParseDuration(options.HTTPRetryBackoff)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "http-retry-backoff %s\n", err.Error())
+			os.Exit(1)
+		}
+		breakerTimeout, err := time.ParseDuration(options.BreakerTimeout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "breaker-timeout %s\n", err.Error())
+			os.Exit(1)
+		}
+		resolver = resources.NewHTTPResolverWithOptions(resources.HTTPOptions{
+			Timeout:              10 * time.Second,
+			AllowedHosts:         options.AllowedHosts,
+			DeniedHosts:          options.DeniedHosts,
+			AllowPrivateNetworks: options.AllowPrivateNetworks,
+			MaxBodyLength:        options.MaxSourceSize * 1024 * 1024,
+			Retries:              options.HTTPRetries,
+			RetryBackoff:         retryBackoff,
+			BreakerThreshold:     options.BreakerThreshold,
+			BreakerTimeout:       breakerTimeout,
+		})
+	case options.Resolver == "file":
+		if info, err := os.Stat(options.FileRoot); err != nil || !info.IsDir() {
+			fmt.Fprintf(os.Stderr, "file-root must be a directory: %q\n", options.FileRoot)
+			os.Exit(1)
+		}
+		resolver = resources.NewFileResolver(options.FileRoot)
+	case options.Resolver == "s3":
+		var err error
+		resolver, err = resources.NewS3Resolver(resources.S3Options{
+			Endpoint:      options.S3Endpoint,
+			Region:        options.S3Region,
+			Credentials:   resources.CredentialsFromEnv(),
+			PathStyle:     options.S3PathStyle,
+			Client:        &http.Client{Timeout: 10 * time.Second},
+			MaxBodyLength: options.MaxSourceSize * 1024 * 1024,
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	if options.CacheDir != "" {
+		ttl, err := time.ParseDuration(options.CacheTTL)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cache-ttl %s\n", err.Error())
+			os.Exit(1)
+		}
+		resolver, err = resources.NewCachingResolver(resolver, resources.CacheOptions{
+			Dir:      options.CacheDir,
+			MaxBytes: options.CacheSize * 1024 * 1024,
+			TTL:      ttl,
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cache-dir %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	var derivativeCache derivatives.Cache
+	switch options.DerivativeCache {
+	case "memory":
+		derivativeCache = derivatives.NewMemoryCache(options.DerivativeCacheSize * 1024 * 1024)
+	case "disk":
+		if options.DerivativeCacheDir == "" {
+			fmt.Fprintf(os.Stderr, "derivative-cache-dir is required for the disk derivative cache\n")
+			os.Exit(1)
+		}
+		var err error
+		derivativeCache, err = derivatives.NewDiskCache(options.DerivativeCacheDir,
+			options.DerivativeCacheSize*1024*1024)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "derivative-cache-dir %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	maxQueueWait, err := time.ParseDuration(options.MaxQueueWait)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "max-queue-wait %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	tiling := iiif.Tiling{
+		Width:        options.TileWidth,
+		ScaleFactors: options.TileScaleFactors,
+	}
+
 	server := server.NewServer(server.ServerOptions{
-		ResourceResolver: resources.HTTPResolver,
-		Processor:        iiif.DefaultProcessor,
-		MaxAge:           maxAge,
+		ResourceResolver: resolver,
+		Processor: iiif.NewProcessor(iiif.ProcessorOptions{
+			Tiling:         tiling,
+			LevelCacheSize: options.LevelCacheSize * 1024 * 1024,
+			MaxWidth:       options.MaxImageWidth,
+			MaxHeight:      options.MaxImageHeight,
+			MaxPixels:      options.MaxImagePixels,
+			MemoryBudget:   options.MemoryBudget * 1024 * 1024,
+		}),
+		MaxAge:                  maxAge,
+		CanonicalRedirectStatus: canonicalRedirectStatus,
+		CORSOrigins:             options.CORSOrigins,
+		Tiling:                  tiling,
+		DerivativeCache:         derivativeCache,
+		MaxConcurrentProcesses:  options.MaxConcurrentProcesses,
+		MaxQueuedProcesses:      options.MaxQueuedProcesses,
+		MaxQueueWait:            maxQueueWait,
+		StreamThreshold:         options.StreamThreshold * 1024,
 	})
 	if err := server.Run(ensureAddressWithPort(options.ListenAddress, 7073)); err != nil {
 		log.Fatal(err)
 	}
 }
 
+func readResolverConfig(fileName string) (resources.Resolver, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	config, err := resources.ReadConfig(f)
+	if err != nil {
+		return nil, err
+	}
+	return resources.NewResolverFromConfig(config)
+}
+
 func ensureAddressWithPort(address string, defaultPort int) string {
 	if address == "" {
 		return fmt.Sprintf(":%d", defaultPort)
@@ -0,0 +1,122 @@
+package resources
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// breaker is a circuit breaker for each host. After a number of
+// consecutive failures, requests to a host fail immediately until a
+// timeout has passed. Then a single request is let through to see whether
+// the host has recovered.
+type breaker struct {
+	threshold int
+	timeout   time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*breakerState
+}
+
+type breakerState struct {
+	failures  int
+	openUntil time.Time
+	trying    bool
+}
+
+// newBreaker returns a circuit breaker, or nil if threshold is zero.
+func newBreaker(threshold int, timeout time.Duration) *breaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &breaker{
+		threshold: threshold,
+		timeout:   timeout,
+		hosts:     map[string]*breakerState{},
+	}
+}
+
+// allow returns whether a request to a host may be made. Every allowed
+// request must be followed by a call to record.
+func (b *breaker) allow(host string) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s, ok := b.hosts[host]
+	if !ok || s.failures < b.threshold {
+		return true
+	}
+	if s.trying || time.Now().Before(s.openUntil) {
+		return false
+	}
+	log.Printf("Circuit breaker: Trying %s again", host)
+	s.trying = true
+	return true
+}
+
+// record updates the state of a host with the outcome of a request.
+// Errors caused by the context say nothing about the host.
+func (b *breaker) record(host string, err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s, ok := b.hosts[host]
+	if !ok {
+		s = &breakerState{}
+		b.hosts[host] = s
+	}
+	trying := s.trying
+	s.trying = false
+
+	switch {
+	case err == context.Canceled || err == context.DeadlineExceeded:
+		if trying {
+			s.openUntil = time.Time{}
+		}
+	case isTransient(err):
+		s.failures++
+		if s.failures >= b.threshold {
+			if trying || s.failures == b.threshold {
+				log.Printf("Circuit breaker: %s is down after %d failures, failing fast for %s",
+					host, s.failures, b.timeout)
+			}
+			s.openUntil = time.Now().Add(b.timeout)
+		}
+	default:
+		if s.failures >= b.threshold {
+			log.Printf("Circuit breaker: %s has recovered", host)
+		}
+		delete(b.hosts, host)
+	}
+}
+
+// openError is returned for requests to a host whose breaker is open.
+func openError(identifier string) error {
+	return Unavailable{
+		Identifier: identifier,
+		Message:    "origin is failing, not trying again yet",
+		StatusCode: http.StatusServiceUnavailable,
+	}
+}
+
+// isTransient returns whether an error could be caused by a temporary
+// failure of the origin: a failed connection, or a 502, 503 or 504 status.
+func isTransient(err error) bool {
+	e, ok := err.(Unavailable)
+	if !ok {
+		return false
+	}
+	switch e.StatusCode {
+	case 0, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+package resources_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/t11e/picaxe/resources"
+)
+
+func TestHTTPResolverWithOptions_breaker(t *testing.T) {
+	var requests, down int32 = 0, 1
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.LoadInt32(&down) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte("hello"))
+	}))
+	defer ts.Close()
+
+	resolver := resources.NewHTTPResolverWithOptions(resources.HTTPOptions{
+		AllowPrivateNetworks: true,
+		BreakerThreshold:     2,
+		BreakerTimeout:       50 * time.Millisecond,
+	})
+	get := func() error {
+		r, err := resolver.GetResource(context.Background(), ts.URL+"/foo.png")
+		if err == nil {
+			r.Close()
+		}
+		return err
+	}
+	assertStatus := func(status int, err error) {
+		if assert.IsType(t, resources.Unavailable{}, err) {
+			assert.Equal(t, status, err.(resources.Unavailable).StatusCode)
+		}
+	}
+
+	assertStatus(http.StatusBadGateway, get())
+	assertStatus(http.StatusBadGateway, get())
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+
+	// Open: fails fast
+	assertStatus(http.StatusServiceUnavailable, get())
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+
+	// Half-open: one request is let through, and fails
+	time.Sleep(60 * time.Millisecond)
+	assertStatus(http.StatusBadGateway, get())
+	assertStatus(http.StatusServiceUnavailable, get())
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+
+	// Half-open: the host has recovered
+	atomic.StoreInt32(&down, 0)
+	time.Sleep(60 * time.Millisecond)
+	assert.NoError(t, get())
+	assert.NoError(t, get())
+	assert.Equal(t, int32(5), atomic.LoadInt32(&requests))
+
+	// Other hosts are unaffected by failures of one
+	atomic.StoreInt32(&down, 1)
+	assertStatus(http.StatusBadGateway, get())
+	assertStatus(http.StatusBadGateway, get())
+	assertStatus(http.StatusServiceUnavailable, get())
+	_, err := resolver.GetResource(context.Background(),
+		"http://localhost"+ts.URL[len("http://127.0.0.1"):]+"/foo.png")
+	assertStatus(http.StatusBadGateway, err)
+}
@@ -0,0 +1,376 @@
+package resources
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheOptions configures a resolver created by NewCachingResolver.
+type CacheOptions struct {
+	// Dir is the directory that resources are stored in. It is created if
+	// it doesn't exist.
+	Dir string
+
+	// MaxBytes bounds the total size of the stored resources. The least
+	// recently used ones are removed to make room for new ones.
+	MaxBytes int64
+
+	// TTL is how long a stored resource is used without asking the
+	// resolver whether it has changed.
+	TTL time.Duration
+}
+
+// cacheEntry is a stored resource. Its metadata is kept in a JSON file
+// next to the data file.
+type cacheEntry struct {
+	Identifier  string     `json:"identifier"`
+	Validators  Validators `json:"validators"`
+	ContentType string     `json:"contentType,omitempty"`
+	Fetched     time.Time  `json:"fetched"`
+	Size        int64      `json:"size"`
+
+	key string
+}
+
+type cachingResolver struct {
+	resolver Resolver
+	opts     CacheOptions
+
+	mu      sync.Mutex
+	bytes   int64
+	lru     *list.List
+	entries map[string]*list.Element
+	calls   map[string]*cacheCall
+}
+
+// cacheCall is a fetch in progress, which concurrent callers wait for.
+type cacheCall struct {
+	done   chan struct{}
+	stored bool
+	err    error
+}
+
+// NewCachingResolver returns a resource resolver that stores resources
+// from another resolver on local disk. Stored resources older than the TTL
+// are revalidated with the resolver if it implements ConditionalResolver,
+// and fetched again otherwise. Concurrent requests for a resource that
+// isn't stored share a single fetch, unless it is too large to store.
+func NewCachingResolver(resolver Resolver, opts CacheOptions) (Resolver, error) {
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return nil, err
+	}
+	c := &cachingResolver{
+		resolver: resolver,
+		opts:     opts,
+		lru:      list.New(),
+		entries:  map[string]*list.Element{},
+		calls:    map[string]*cacheCall{},
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// GetResource implements interface Resolver.
+func (c *cachingResolver) GetResource(ctx context.Context, identifier string) (*Resource, error) {
+	key := cacheKey(identifier)
+
+	c.mu.Lock()
+	if call, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if isContextError(call.err) {
+			// The request that was fetching it was canceled, not this one
+			return c.GetResource(ctx, identifier)
+		}
+		if call.err != nil {
+			return nil, call.err
+		}
+		if call.stored {
+			if r, err := c.openKey(key); err == nil {
+				return r, nil
+			}
+		}
+		return c.resolver.GetResource(ctx, identifier)
+	}
+	call := &cacheCall{done: make(chan struct{})}
+	c.calls[key] = call
+	var entry *cacheEntry
+	if e, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(e)
+		copied := *e.Value.(*cacheEntry)
+		entry = &copied
+	}
+	c.mu.Unlock()
+
+	r, stored, err := c.get(ctx, identifier, key, entry)
+
+	c.mu.Lock()
+	delete(c.calls, key)
+	c.mu.Unlock()
+	call.stored, call.err = stored, err
+	close(call.done)
+
+	return r, err
+}
+
+func isContextError(err error) bool {
+	return err == context.Canceled || err == context.DeadlineExceeded
+}
+
+// get returns the stored resource if it is fresh or still valid, and
+// fetches it otherwise. It also returns whether the resource is stored.
+func (c *cachingResolver) get(
+	ctx context.Context,
+	identifier, key string,
+	entry *cacheEntry) (*Resource, bool, error) {
+	var cached *Resource
+	if entry != nil {
+		var err error
+		if cached, err = c.open(entry); err != nil {
+			log.Printf("Cache: Unable to read %s: %s", c.dataPath(key), err)
+			c.remove(key)
+		} else if time.Since(entry.Fetched) < c.opts.TTL {
+			return cached, true, nil
+		}
+	}
+
+	var r *Resource
+	var err error
+	if cr, ok := c.resolver.(ConditionalResolver); ok && cached != nil {
+		r, err = cr.GetResourceIfModified(ctx, identifier, entry.Validators)
+	} else {
+		r, err = c.resolver.GetResource(ctx, identifier)
+	}
+	if err == ErrNotModified && cached != nil {
+		entry.Fetched = time.Now()
+		if err := c.writeMetadata(entry); err != nil {
+			log.Printf("Cache: Unable to update %s: %s", c.metadataPath(key), err)
+		}
+		c.update(entry)
+		return cached, true, nil
+	}
+	if cached != nil {
+		cached.Close()
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	entry = &cacheEntry{
+		Identifier:  identifier,
+		Validators:  r.Validators(),
+		ContentType: r.ContentType,
+		Fetched:     time.Now(),
+		Size:        r.ContentLength,
+		key:         key,
+	}
+	if entry.Size > c.opts.MaxBytes {
+		c.remove(key)
+		return r, false, nil
+	}
+	err = c.store(entry, r)
+	if err != nil {
+		log.Printf("Cache: Unable to store %q: %s", identifier, err)
+	}
+	// The download is returned rather than the stored copy, which may
+	// already have been evicted or replaced
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		r.Close()
+		return nil, false, err
+	}
+	return r, err == nil, nil
+}
+
+// open returns a stored resource.
+func (c *cachingResolver) open(entry *cacheEntry) (*Resource, error) {
+	f, err := os.Open(c.dataPath(entry.key))
+	if err != nil {
+		return nil, err
+	}
+	r, err := newFileResource(f, f.Close)
+	if err != nil {
+		return nil, err
+	}
+	r.ContentType = entry.ContentType
+	r.ETag = entry.Validators.ETag
+	if t, err := http.ParseTime(entry.Validators.LastModified); err == nil {
+		r.LastModified = t
+	}
+	return r, nil
+}
+
+// openKey returns a stored resource by key.
+func (c *cachingResolver) openKey(key string) (*Resource, error) {
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	var entry cacheEntry
+	if ok {
+		entry = *e.Value.(*cacheEntry)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return c.open(&entry)
+}
+
+// store writes a resource to disk and adds it to the index, evicting
+// others to make room.
+func (c *cachingResolver) store(entry *cacheEntry, r io.Reader) error {
+	size, err := writeFileAtomically(c.dataPath(entry.key), r)
+	if err != nil {
+		return err
+	}
+	entry.Size = size
+	if err := c.writeMetadata(entry); err != nil {
+		os.Remove(c.dataPath(entry.key))
+		return err
+	}
+	c.update(entry)
+	return nil
+}
+
+// update adds or replaces an entry in the index, evicting the least
+// recently used entries while the cache is too large.
+func (c *cachingResolver) update(entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[entry.key]; ok {
+		c.bytes -= e.Value.(*cacheEntry).Size
+		c.lru.Remove(e)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.bytes += entry.Size
+
+	for c.bytes > c.opts.MaxBytes {
+		oldest := c.lru.Back().Value.(*cacheEntry)
+		c.removeLocked(oldest.key)
+	}
+}
+
+func (c *cachingResolver) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(key)
+}
+
+// removeLocked deletes an entry. The caller must hold c.mu.
+func (c *cachingResolver) removeLocked(key string) {
+	if e, ok := c.entries[key]; ok {
+		c.bytes -= e.Value.(*cacheEntry).Size
+		c.lru.Remove(e)
+		delete(c.entries, key)
+	}
+	os.Remove(c.metadataPath(key))
+	os.Remove(c.dataPath(key))
+}
+
+// load builds the index from the entries on disk, most recently fetched
+// first.
+func (c *cachingResolver) load() error {
+	paths, err := filepath.Glob(filepath.Join(c.opts.Dir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	var entries []*cacheEntry
+	for _, path := range paths {
+		key := strings.TrimSuffix(filepath.Base(path), ".json")
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var entry cacheEntry
+		if err := json.Unmarshal(b, &entry); err != nil || cacheKey(entry.Identifier) != key {
+			log.Printf("Cache: Ignoring invalid entry %s", path)
+			continue
+		}
+		entry.key = key
+		entries = append(entries, &entry)
+	}
+	sort.Sort(byFetched(entries))
+
+	for _, entry := range entries {
+		c.entries[entry.key] = c.lru.PushBack(entry)
+		c.bytes += entry.Size
+	}
+	for c.bytes > c.opts.MaxBytes {
+		c.removeLocked(c.lru.Back().Value.(*cacheEntry).key)
+	}
+	return nil
+}
+
+func (c *cachingResolver) writeMetadata(entry *cacheEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = writeFileAtomically(c.metadataPath(entry.key), bytes.NewReader(b))
+	return err
+}
+
+func (c *cachingResolver) dataPath(key string) string {
+	return filepath.Join(c.opts.Dir, key)
+}
+
+func (c *cachingResolver) metadataPath(key string) string {
+	return filepath.Join(c.opts.Dir, key+".json")
+}
+
+func cacheKey(identifier string) string {
+	sum := sha256.Sum256([]byte(identifier))
+	return hex.EncodeToString(sum[:])
+}
+
+// writeFileAtomically writes a file through a temporary file, so that
+// readers never see a partial file. It returns the number of bytes written.
+func writeFileAtomically(path string, r io.Reader) (int64, error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return 0, err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return 0, fmt.Errorf("unable to rename %s: %s", f.Name(), err)
+	}
+	return n, nil
+}
+
+// byFetched sorts entries by descending fetch time.
+type byFetched []*cacheEntry
+
+func (e byFetched) Len() int           { return len(e) }
+func (e byFetched) Less(i, j int) bool { return e[i].Fetched.After(e[j].Fetched) }
+func (e byFetched) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
@@ -0,0 +1,137 @@
+package resources_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/t11e/picaxe/resources"
+)
+
+type testOrigin struct {
+	*httptest.Server
+	requests, notModified int32
+	release               chan struct{}
+}
+
+func newTestOrigin() *testOrigin {
+	o := &testOrigin{}
+	o.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&o.requests, 1)
+		if o.release != nil {
+			<-o.release
+		}
+		etag := fmt.Sprintf(`"%s"`, r.URL.Path)
+		if r.Header.Get("If-None-Match") == etag {
+			atomic.AddInt32(&o.notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Write([]byte("body " + r.URL.Path))
+	}))
+	return o
+}
+
+func newTestCache(t *testing.T, dir string, origin *testOrigin, maxBytes int64, ttl time.Duration) resources.Resolver {
+	resolver, err := resources.NewCachingResolver(resources.NewHTTPResolver(http.DefaultClient),
+		resources.CacheOptions{Dir: dir, MaxBytes: maxBytes, TTL: ttl})
+	require.NoError(t, err)
+	return resolver
+}
+
+func assertResource(t *testing.T, resolver resources.Resolver, identifier, expected string) {
+	r, err := resolver.GetResource(context.Background(), identifier)
+	require.NoError(t, err)
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, expected, string(b))
+}
+
+func TestCachingResolver(t *testing.T) {
+	origin := newTestOrigin()
+	defer origin.Close()
+
+	dir, err := ioutil.TempDir("", "picaxe")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	resolver := newTestCache(t, dir, origin, 1024, time.Hour)
+	assertResource(t, resolver, origin.URL+"/a", "body /a")
+	assertResource(t, resolver, origin.URL+"/a", "body /a")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&origin.requests))
+
+	// Entries survive restarts
+	resolver = newTestCache(t, dir, origin, 1024, time.Hour)
+	assertResource(t, resolver, origin.URL+"/a", "body /a")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&origin.requests))
+
+	// Expired entries are revalidated
+	resolver = newTestCache(t, dir, origin, 1024, 0)
+	assertResource(t, resolver, origin.URL+"/a", "body /a")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&origin.requests))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&origin.notModified))
+
+	_, err = resolver.GetResource(context.Background(), "ftp://example.com/")
+	assert.IsType(t, resources.InvalidIdentifier{}, err)
+}
+
+func TestCachingResolver_eviction(t *testing.T) {
+	origin := newTestOrigin()
+	defer origin.Close()
+
+	dir, err := ioutil.TempDir("", "picaxe")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	resolver := newTestCache(t, dir, origin, 10, time.Hour)
+	assertResource(t, resolver, origin.URL+"/a", "body /a")
+	assertResource(t, resolver, origin.URL+"/b", "body /b")
+	assertResource(t, resolver, origin.URL+"/b", "body /b")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&origin.requests))
+
+	assertResource(t, resolver, origin.URL+"/a", "body /a")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&origin.requests))
+
+	// Too large to store at all
+	assertResource(t, resolver, origin.URL+"/toolarge", "body /toolarge")
+	assertResource(t, resolver, origin.URL+"/toolarge", "body /toolarge")
+	assert.Equal(t, int32(5), atomic.LoadInt32(&origin.requests))
+}
+
+func TestCachingResolver_concurrentMisses(t *testing.T) {
+	origin := newTestOrigin()
+	origin.release = make(chan struct{})
+	defer origin.Close()
+
+	dir, err := ioutil.TempDir("", "picaxe")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	resolver := newTestCache(t, dir, origin, 1024, time.Hour)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assertResource(t, resolver, origin.URL+"/a", "body /a")
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(origin.release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&origin.requests))
+}
@@ -0,0 +1,103 @@
+package resources
+
+import (
+	"context"
+	"sort"
+	"strings"
+)
+
+// Route sends identifiers with a prefix to a resolver.
+type Route struct {
+	// Prefix is matched against the start of identifiers, such as "s3:" or
+	// "https://".
+	Prefix string
+
+	// StripPrefix removes the prefix from identifiers before they are
+	// passed to the resolver.
+	StripPrefix bool
+
+	Resolver Resolver
+}
+
+type compositeResolver struct {
+	routes []Route
+}
+
+// NewCompositeResolver returns a resource resolver that passes each
+// identifier to the resolver of the route with the longest matching prefix.
+// Identifiers that match no route are invalid.
+func NewCompositeResolver(routes []Route) Resolver {
+	sorted := append([]Route(nil), routes...)
+	sort.Stable(byPrefixLength(sorted))
+	return &compositeResolver{
+		routes: sorted,
+	}
+}
+
+// GetResource implements interface Resolver.
+func (c compositeResolver) GetResource(ctx context.Context, identifier string) (*Resource, error) {
+	return c.GetResourceIfModified(ctx, identifier, Validators{})
+}
+
+// GetResourceIfModified implements interface ConditionalResolver. Resources
+// of resolvers that don't implement it are always returned.
+func (c compositeResolver) GetResourceIfModified(
+	ctx context.Context,
+	identifier string,
+	validators Validators) (*Resource, error) {
+	for _, route := range c.routes {
+		if !strings.HasPrefix(identifier, route.Prefix) {
+			continue
+		}
+		child := identifier
+		if route.StripPrefix {
+			child = strings.TrimPrefix(identifier, route.Prefix)
+		}
+
+		var r *Resource
+		var err error
+		if cr, ok := route.Resolver.(ConditionalResolver); ok {
+			r, err = cr.GetResourceIfModified(ctx, child, validators)
+		} else {
+			r, err = route.Resolver.GetResource(ctx, child)
+		}
+		if err != nil {
+			return nil, withIdentifier(err, identifier)
+		}
+		return r, nil
+	}
+	return nil, InvalidIdentifier{
+		Message:    "no resolver for identifier",
+		Identifier: identifier,
+	}
+}
+
+// byPrefixLength sorts routes by descending prefix length.
+type byPrefixLength []Route
+
+func (r byPrefixLength) Len() int           { return len(r) }
+func (r byPrefixLength) Less(i, j int) bool { return len(r[i].Prefix) > len(r[j].Prefix) }
+func (r byPrefixLength) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+// withIdentifier replaces the identifier in errors from a child resolver
+// with the one that the client asked for.
+func withIdentifier(err error, identifier string) error {
+	switch e := err.(type) {
+	case InvalidIdentifier:
+		e.Identifier = identifier
+		return e
+	case NotFound:
+		e.Identifier = identifier
+		return e
+	case Forbidden:
+		e.Identifier = identifier
+		return e
+	case TooLarge:
+		e.Identifier = identifier
+		return e
+	case Unavailable:
+		e.Identifier = identifier
+		return e
+	}
+	return err
+}
@@ -0,0 +1,109 @@
+package resources_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/t11e/picaxe/resources"
+	"github.com/t11e/picaxe/resources/mocks"
+)
+
+func TestCompositeResolver(t *testing.T) {
+	fs := &mocks.Resolver{}
+	fs.On("GetResource", mock.Anything, "foo.png").Return(resources.NewResource([]byte("fs")), nil)
+	fs.On("GetResource", mock.Anything, "missing.png").Return(nil, resources.NotFound{Identifier: "missing.png"})
+
+	archive := &mocks.Resolver{}
+	archive.On("GetResource", mock.Anything, "foo.png").Return(resources.NewResource([]byte("archive")), nil)
+
+	web := &mocks.Resolver{}
+	web.On("GetResource", mock.Anything, "http://example.com/foo.png").Return(resources.NewResource([]byte("web")), nil)
+
+	resolver := resources.NewCompositeResolver([]resources.Route{
+		{Prefix: "fs:", StripPrefix: true, Resolver: fs},
+		{Prefix: "fs:archive/", StripPrefix: true, Resolver: archive},
+		{Prefix: "http://", Resolver: web},
+	})
+
+	for identifier, expected := range map[string]string{
+		"fs:foo.png":                 "fs",
+		"fs:archive/foo.png":         "archive",
+		"http://example.com/foo.png": "web",
+	} {
+		r, err := resolver.GetResource(context.Background(), identifier)
+		require.NoError(t, err, identifier)
+		b, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(b), identifier)
+	}
+
+	_, err := resolver.GetResource(context.Background(), "fs:missing.png")
+	assert.Equal(t, resources.NotFound{Identifier: "fs:missing.png"}, err)
+
+	for _, identifier := range []string{"s3:foo/bar.png", "foo.png", "https://example.com/foo.png"} {
+		_, err := resolver.GetResource(context.Background(), identifier)
+		require.Error(t, err, identifier)
+		assert.IsType(t, resources.InvalidIdentifier{}, err, identifier)
+	}
+}
+
+func TestNewResolverFromConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "picaxe")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "foo.png"), []byte("hello"), 0644))
+
+	config, err := resources.ReadConfig(strings.NewReader(`{
+		"routes": [
+			{"prefix": "http://", "type": "http"},
+			{"prefix": "fs:", "type": "file", "root": "` + dir + `"},
+			{"prefix": "s3:", "type": "s3", "endpoint": "http://localhost:9000", "pathStyle": true},
+			{"prefix": "masters:", "type": "template", "template": "https://origin.internal/{id}.jpg", "pattern": "[0-9]+"}
+		]
+	}`))
+	require.NoError(t, err)
+	require.Len(t, config.Routes, 4)
+	assert.Equal(t, resources.RouteConfig{Prefix: "s3:", Type: "s3",
+		Endpoint: "http://localhost:9000", PathStyle: true}, config.Routes[2])
+
+	resolver, err := resources.NewResolverFromConfig(config)
+	require.NoError(t, err)
+
+	r, err := resolver.GetResource(context.Background(), "fs:foo.png")
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello"), b)
+
+	_, err = resolver.GetResource(context.Background(), "masters:abc")
+	assert.IsType(t, resources.InvalidIdentifier{}, err)
+
+	_, err = resolver.GetResource(context.Background(), "archive:foo.png")
+	assert.IsType(t, resources.InvalidIdentifier{}, err)
+}
+
+func TestNewResolverFromConfig_invalid(t *testing.T) {
+	for _, config := range []string{
+		`{"routes": [{"prefix": "", "type": "http"}]}`,
+		`{"routes": [{"prefix": "x:", "type": "ftp"}]}`,
+		`{"routes": [{"prefix": "fs:", "type": "file", "root": "/nonexistent"}]}`,
+		`{"routes": [{"prefix": "m:", "type": "template", "template": "https://origin.internal/"}]}`,
+		`{"routes": [{"prefix": "m:", "type": "template", "template": "https://origin.internal/{id}", "pattern": "("}]}`,
+	} {
+		c, err := resources.ReadConfig(strings.NewReader(config))
+		require.NoError(t, err)
+		_, err = resources.NewResolverFromConfig(c)
+		assert.Error(t, err, config)
+	}
+
+	_, err := resources.ReadConfig(strings.NewReader(`{"routes": `))
+	assert.Error(t, err)
+}
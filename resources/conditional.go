@@ -0,0 +1,47 @@
+package resources
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// Validators identify a version of a resource, as described in
+// https://tools.ietf.org/html/rfc7232.
+type Validators struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+}
+
+// IsZero returns whether there are no validators.
+func (v Validators) IsZero() bool {
+	return v.ETag == "" && v.LastModified == ""
+}
+
+// ErrNotModified is returned by ConditionalResolver.GetResourceIfModified
+// when the resource still matches the validators.
+var ErrNotModified = errors.New("resource not modified")
+
+// ConditionalResolver is a Resolver that can tell whether a resource has
+// changed without downloading it again.
+type ConditionalResolver interface {
+	Resolver
+
+	// GetResourceIfModified returns the resource, or ErrNotModified if it
+	// still matches the given validators.
+	GetResourceIfModified(
+		ctx context.Context,
+		identifier string,
+		validators Validators) (*Resource, error)
+}
+
+// setConditionalHeaders makes a request conditional on the resource not
+// matching the validators.
+func setConditionalHeaders(req *http.Request, validators Validators) {
+	if validators.ETag != "" {
+		req.Header.Set("If-None-Match", validators.ETag)
+	}
+	if validators.LastModified != "" {
+		req.Header.Set("If-Modified-Since", validators.LastModified)
+	}
+}
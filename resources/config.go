@@ -0,0 +1,135 @@
+package resources
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+)
+
+// Config is a routing table of resolvers, usually read from a JSON file
+// with ReadConfig.
+type Config struct {
+	Routes []RouteConfig `json:"routes"`
+}
+
+// RouteConfig configures a Route and its resolver.
+type RouteConfig struct {
+	// Prefix of identifiers to send to the resolver. Except for "http"
+	// resolvers, which expect whole URLs, the prefix is removed before the
+	// identifier is passed on.
+	Prefix string `json:"prefix"`
+
+	// Type is one of "http", "file", "s3" and "template".
+	Type string `json:"type"`
+
+	// AllowedHosts, DeniedHosts and AllowPrivateNetworks configure "http"
+	// resolvers, as in HTTPOptions.
+	AllowedHosts         []string `json:"allowedHosts,omitempty"`
+	DeniedHosts          []string `json:"deniedHosts,omitempty"`
+	AllowPrivateNetworks bool     `json:"allowPrivateNetworks,omitempty"`
+
+	// Root is the root directory of "file" resolvers.
+	Root string `json:"root,omitempty"`
+
+	// Endpoint, Region and PathStyle configure "s3" resolvers, as in
+	// S3Options. Credentials are taken from the environment.
+	Endpoint  string `json:"endpoint,omitempty"`
+	Region    string `json:"region,omitempty"`
+	PathStyle bool   `json:"pathStyle,omitempty"`
+
+	// Template and Pattern configure "template" resolvers, as in
+	// NewTemplateResolver.
+	Template string `json:"template,omitempty"`
+	Pattern  string `json:"pattern,omitempty"`
+
+	// MaxBodyLength is the largest resource that "http", "s3" and
+	// "template" resolvers download. It defaults to DefaultMaxBodyLength.
+	MaxBodyLength int64 `json:"maxBodyLength,omitempty"`
+
+	// Retries and BreakerThreshold configure "http" and "template"
+	// resolvers, as in HTTPOptions.
+	Retries          int `json:"retries,omitempty"`
+	BreakerThreshold int `json:"breakerThreshold,omitempty"`
+}
+
+// ReadConfig reads a JSON routing table.
+func ReadConfig(r io.Reader) (*Config, error) {
+	var config Config
+	decoder := json.NewDecoder(r)
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("invalid resolver configuration: %s", err)
+	}
+	return &config, nil
+}
+
+// NewResolverFromConfig returns a composite resolver with the routes of a
+// configuration.
+func NewResolverFromConfig(config *Config) (Resolver, error) {
+	routes := make([]Route, 0, len(config.Routes))
+	for _, rc := range config.Routes {
+		if rc.Prefix == "" {
+			return nil, fmt.Errorf("resolver of type %q has no prefix", rc.Type)
+		}
+
+		route := Route{Prefix: rc.Prefix, StripPrefix: true}
+		switch rc.Type {
+		case "http":
+			route.StripPrefix = false
+			route.Resolver = NewHTTPResolverWithOptions(HTTPOptions{
+				Timeout:              defaultHTTPClient.Timeout,
+				AllowedHosts:         rc.AllowedHosts,
+				DeniedHosts:          rc.DeniedHosts,
+				AllowPrivateNetworks: rc.AllowPrivateNetworks,
+				MaxBodyLength:        rc.MaxBodyLength,
+				Retries:              rc.Retries,
+				BreakerThreshold:     rc.BreakerThreshold,
+			})
+		case "file":
+			if info, err := os.Stat(rc.Root); err != nil || !info.IsDir() {
+				return nil, fmt.Errorf("root of resolver %q must be a directory: %q", rc.Prefix, rc.Root)
+			}
+			route.Resolver = NewFileResolver(rc.Root)
+		case "s3":
+			resolver, err := NewS3Resolver(S3Options{
+				Endpoint:      rc.Endpoint,
+				Region:        rc.Region,
+				Credentials:   CredentialsFromEnv(),
+				PathStyle:     rc.PathStyle,
+				Client:        defaultHTTPClient,
+				MaxBodyLength: rc.MaxBodyLength,
+			})
+			if err != nil {
+				return nil, err
+			}
+			route.Resolver = resolver
+		case "template":
+			var pattern *regexp.Regexp
+			if rc.Pattern != "" {
+				var err error
+				if pattern, err = regexp.Compile(rc.Pattern); err != nil {
+					return nil, fmt.Errorf("resolver %q has invalid pattern: %s", rc.Prefix, err)
+				}
+			}
+			if rc.MaxBodyLength == 0 {
+				rc.MaxBodyLength = DefaultMaxBodyLength
+			}
+			resolver, err := newTemplateResolver(rc.Template, pattern, httpResolver{
+				client:        defaultHTTPClient,
+				maxBodyLength: rc.MaxBodyLength,
+				retries:       rc.Retries,
+				retryBackoff:  DefaultRetryBackoff,
+				breaker:       newBreaker(rc.BreakerThreshold, DefaultBreakerTimeout),
+			})
+			if err != nil {
+				return nil, err
+			}
+			route.Resolver = resolver
+		default:
+			return nil, fmt.Errorf("resolver %q has unknown type %q", rc.Prefix, rc.Type)
+		}
+		routes = append(routes, route)
+	}
+	return NewCompositeResolver(routes), nil
+}
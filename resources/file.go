@@ -0,0 +1,118 @@
+package resources
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type fileResolver struct {
+	root string
+}
+
+// NewFileResolver returns a resource resolver that reads files under a root
+// directory. Identifiers are slash-separated paths relative to the root;
+// paths that would leave the root, whether through ".." or symbolic links,
+// are rejected.
+func NewFileResolver(root string) Resolver {
+	if abs, err := filepath.Abs(root); err == nil {
+		root = abs
+	}
+	if real, err := filepath.EvalSymlinks(root); err == nil {
+		root = real
+	}
+	return &fileResolver{
+		root: root,
+	}
+}
+
+// GetResource implements interface Resolver.
+func (f fileResolver) GetResource(ctx context.Context, identifier string) (*Resource, error) {
+	path, err := f.resolvePath(identifier)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, NotFound{Identifier: identifier}
+		}
+		if os.IsPermission(err) {
+			return nil, Forbidden{Identifier: identifier}
+		}
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		file.Close()
+		return nil, InvalidIdentifier{
+			Message:    "not a file",
+			Identifier: identifier,
+		}
+	}
+
+	return &Resource{
+		ReadSeeker:    file,
+		ContentLength: info.Size(),
+		ContentType:   mime.TypeByExtension(filepath.Ext(path)),
+		LastModified:  info.ModTime(),
+		close:         file.Close,
+	}, nil
+}
+
+// resolvePath returns the real path of the file for an identifier,
+// following symbolic links, and checks that it is under the root.
+func (f fileResolver) resolvePath(identifier string) (string, error) {
+	if err := validatePath(identifier); err != nil {
+		return "", InvalidIdentifier{
+			Message:    err.Error(),
+			Identifier: identifier,
+		}
+	}
+
+	path, err := filepath.EvalSymlinks(filepath.Join(f.root, filepath.FromSlash(identifier)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", NotFound{Identifier: identifier}
+		}
+		if os.IsPermission(err) {
+			return "", Forbidden{Identifier: identifier}
+		}
+		return "", err
+	}
+	if path != f.root && !strings.HasPrefix(path, f.root+string(filepath.Separator)) {
+		return "", InvalidIdentifier{
+			Message:    "outside of root directory",
+			Identifier: identifier,
+		}
+	}
+	return path, nil
+}
+
+func validatePath(identifier string) error {
+	if identifier == "" {
+		return errors.New("empty path")
+	}
+	if strings.ContainsRune(identifier, 0) {
+		return errors.New("path contains NUL")
+	}
+	if strings.HasPrefix(identifier, "/") {
+		return errors.New("absolute path")
+	}
+	for _, elem := range strings.Split(identifier, "/") {
+		if elem == ".." {
+			return fmt.Errorf("path contains %q", elem)
+		}
+	}
+	return nil
+}
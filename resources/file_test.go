@@ -0,0 +1,65 @@
+package resources_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/t11e/picaxe/resources"
+)
+
+func TestFileResolver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "picaxe")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "root")
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "sub"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "sub", "foo.png"), []byte("hello"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "secret.png"), []byte("secret"), 0644))
+	require.NoError(t, os.Symlink(filepath.Join(root, "sub", "foo.png"), filepath.Join(root, "inside.png")))
+	require.NoError(t, os.Symlink(filepath.Join(dir, "secret.png"), filepath.Join(root, "outside.png")))
+	require.NoError(t, os.Symlink(dir, filepath.Join(root, "parent")))
+
+	resolver := resources.NewFileResolver(root)
+
+	t.Run("valid", func(t *testing.T) {
+		for _, identifier := range []string{"sub/foo.png", "inside.png", "./sub//foo.png"} {
+			r, err := resolver.GetResource(context.Background(), identifier)
+			require.NoError(t, err, identifier)
+			b, err := ioutil.ReadAll(r)
+			r.Close()
+			require.NoError(t, err)
+			assert.Equal(t, []byte("hello"), b)
+			assert.Equal(t, int64(5), r.ContentLength)
+			assert.Equal(t, "image/png", r.ContentType)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, identifier := range []string{
+			"",
+			"/etc/passwd",
+			"../secret.png",
+			"sub/../../secret.png",
+			"outside.png",
+			"parent/secret.png",
+			"sub",
+		} {
+			_, err := resolver.GetResource(context.Background(), identifier)
+			require.Error(t, err, identifier)
+			assert.IsType(t, resources.InvalidIdentifier{}, err, identifier)
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		_, err := resolver.GetResource(context.Background(), "sub/bar.png")
+		require.Error(t, err)
+		assert.Equal(t, resources.NotFound{Identifier: "sub/bar.png"}, err)
+	})
+}
@@ -1,11 +1,12 @@
 package resources
 
 import (
-	"bytes"
+	"context"
 	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
@@ -15,19 +16,150 @@ import (
 const HTTPHeaderPixace = "X-Picaxe"
 
 type httpResolver struct {
-	client *http.Client
+	client        *http.Client
+	allowedHosts  []string
+	deniedHosts   []string
+	maxBodyLength int64
+	retries       int
+	retryBackoff  time.Duration
+	breaker       *breaker
 }
 
 // NewHTTPResolver returns a resource resolver that downloads HTTP and HTTPS
-// URLs.
+// URLs with the given client, from any host.
 func NewHTTPResolver(client *http.Client) Resolver {
 	return &httpResolver{
-		client: client,
+		client:        client,
+		maxBodyLength: DefaultMaxBodyLength,
 	}
 }
 
+// HTTPOptions configures a resolver created by NewHTTPResolverWithOptions.
+type HTTPOptions struct {
+	// Timeout limits the time taken by each download.
+	Timeout time.Duration
+
+	// AllowedHosts lists the host names that may be downloaded from. A
+	// pattern of the form "*.example.com" matches any subdomain of
+	// example.com. If empty, all hosts are allowed.
+	AllowedHosts []string
+
+	// DeniedHosts lists host names that may not be downloaded from, even
+	// if they are allowed, in the same form as AllowedHosts.
+	DeniedHosts []string
+
+	// AllowPrivateNetworks allows connections to private, loopback and
+	// link-local addresses, which are refused by default.
+	AllowPrivateNetworks bool
+
+	// Proxy returns the proxy to download through, as for http.Transport.
+	// It defaults to http.ProxyFromEnvironment. Connections to a proxy are
+	// allowed even on a private network, but unless private networks are
+	// allowed, requests are only sent through it to hosts that resolve to
+	// public addresses.
+	Proxy func(*http.Request) (*url.URL, error)
+
+	// MaxBodyLength is the largest resource that is downloaded. It
+	// defaults to DefaultMaxBodyLength.
+	MaxBodyLength int64
+
+	// Retries is the number of times a download is retried after the
+	// connection fails, or the server responds with status 502, 503 or
+	// 504. Downloads that time out are not retried.
+	Retries int
+
+	// RetryBackoff is the delay before the first retry. Each further retry
+	// waits twice as long as the one before, with random jitter. It
+	// defaults to DefaultRetryBackoff.
+	RetryBackoff time.Duration
+
+	// BreakerThreshold is the number of consecutive failures of a host
+	// after which downloads from it fail immediately. Zero disables the
+	// circuit breaker.
+	BreakerThreshold int
+
+	// BreakerTimeout is how long downloads from a failing host fail
+	// immediately, before one is let through to see whether it has
+	// recovered. It defaults to DefaultBreakerTimeout.
+	BreakerTimeout time.Duration
+}
+
+const (
+	// DefaultRetryBackoff is the delay before retrying a failed download,
+	// unless configured otherwise.
+	DefaultRetryBackoff = 100 * time.Millisecond
+
+	// DefaultBreakerTimeout is how long downloads from a failing host
+	// fail immediately, unless configured otherwise.
+	DefaultBreakerTimeout = 30 * time.Second
+)
+
+// NewHTTPResolverWithOptions returns a resource resolver that downloads
+// HTTP and HTTPS URLs from the hosts permitted by the options, including
+// when following redirects.
+func NewHTTPResolverWithOptions(opts HTTPOptions) Resolver {
+	if opts.MaxBodyLength == 0 {
+		opts.MaxBodyLength = DefaultMaxBodyLength
+	}
+	if opts.RetryBackoff == 0 {
+		opts.RetryBackoff = DefaultRetryBackoff
+	}
+	if opts.BreakerTimeout == 0 {
+		opts.BreakerTimeout = DefaultBreakerTimeout
+	}
+	h := &httpResolver{
+		allowedHosts:  opts.AllowedHosts,
+		deniedHosts:   opts.DeniedHosts,
+		maxBodyLength: opts.MaxBodyLength,
+		retries:       opts.Retries,
+		retryBackoff:  opts.RetryBackoff,
+		breaker:       newBreaker(opts.BreakerThreshold, opts.BreakerTimeout),
+	}
+
+	proxy := opts.Proxy
+	if proxy == nil {
+		proxy = http.ProxyFromEnvironment
+	}
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	dial := dialer.DialContext
+	if !opts.AllowPrivateNetworks {
+		proxies := &proxyAddrs{}
+		proxy = proxies.record(proxy)
+		dial = proxies.dialContext(dialer)
+	}
+	h.client = &http.Client{
+		Timeout: opts.Timeout,
+		Transport: &http.Transport{
+			Proxy:                 proxy,
+			DialContext:           dial,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return h.checkHost(req.URL.Hostname())
+		},
+	}
+	return h
+}
+
 // GetResource implements interface Resolver.
-func (h httpResolver) GetResource(identifier string) (io.ReadSeeker, error) {
+func (h httpResolver) GetResource(ctx context.Context, identifier string) (*Resource, error) {
+	return h.GetResourceIfModified(ctx, identifier, Validators{})
+}
+
+// GetResourceIfModified implements interface ConditionalResolver.
+func (h httpResolver) GetResourceIfModified(
+	ctx context.Context,
+	identifier string,
+	validators Validators) (*Resource, error) {
 	u := strings.TrimSpace(identifier)
 
 	if err := h.validateIdentifier(u); err != nil {
@@ -37,33 +169,75 @@ func (h httpResolver) GetResource(identifier string) (io.ReadSeeker, error) {
 		}
 	}
 
-	req, err := http.NewRequest("GET", u, nil)
+	return h.fetch(ctx, identifier, u, validators)
+}
+
+// fetch downloads the URL u of the resource for an identifier, unless it
+// matches the validators. Transient failures are retried.
+func (h httpResolver) fetch(
+	ctx context.Context,
+	identifier, u string,
+	validators Validators) (*Resource, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Add(HTTPHeaderPixace, "1") // Used to prevent loops
+	setConditionalHeaders(req, validators)
 
+	for attempt := 0; ; attempt++ {
+		if !h.breaker.allow(req.URL.Host) {
+			return nil, openError(identifier)
+		}
+		r, err := h.do(ctx, req, identifier, validators)
+		h.breaker.record(req.URL.Host, err)
+
+		if attempt >= h.retries || !isTransient(err) || err.(Unavailable).Timeout {
+			return r, err
+		}
+		delay := backoff(h.retryBackoff, attempt)
+		log.Printf("Retrying %s in %s: %s", u, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// do makes a single request for the resource for an identifier.
+func (h httpResolver) do(
+	ctx context.Context,
+	req *http.Request,
+	identifier string,
+	validators Validators) (*Resource, error) {
 	resp, err := h.client.Do(req)
 	if err != nil {
-		return nil, err
+		if e, ok := blockedCause(err); ok {
+			return nil, InvalidIdentifier{
+				Message:    e.Error(),
+				Identifier: identifier,
+			}
+		}
+		return nil, requestError(ctx, identifier, err)
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && !validators.IsZero() {
+		return nil, ErrNotModified
+	}
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("Could not retrieve %s: Failed with HTTP status %d: %s",
-			u, resp.StatusCode, resp.Status)
+		return nil, statusError(identifier, resp)
 	}
 
-	body, err := ioutil.ReadAll(&io.LimitedReader{
-		R: resp.Body,
-		N: maxBodyLength})
-	if err != nil {
-		return nil, fmt.Errorf("Error retrieving %s: %s", u, err)
-	}
-	if len(body) == maxBodyLength {
-		return nil, fmt.Errorf("Rejecting %s: Body too large (%d)", u, len(body))
-	}
+	return readBody(ctx, resp, identifier, h.maxBodyLength)
+}
 
-	return bytes.NewReader(body), nil
+// backoff returns the delay before a retry: base doubled for each earlier
+// retry, of which a random half is taken off so that clients that failed
+// together don't retry together.
+func backoff(base time.Duration, attempt int) time.Duration {
+	d := base << uint(attempt)
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
 }
 
 func (h httpResolver) validateIdentifier(identifier string) error {
@@ -76,12 +250,26 @@ func (h httpResolver) validateIdentifier(identifier string) error {
 		return fmt.Errorf("not a valid scheme: %q", u.Scheme)
 	}
 
+	return h.checkHost(u.Hostname())
+}
+
+// checkHost returns an error if a host is not allowed.
+func (h httpResolver) checkHost(host string) error {
+	if len(h.allowedHosts) > 0 && !matchHost(host, h.allowedHosts) {
+		return blockedError{host: host}
+	}
+	if matchHost(host, h.deniedHosts) {
+		return blockedError{host: host}
+	}
 	return nil
 }
 
-// HTTPResolver is the default HTTP resolver.
-var HTTPResolver = NewHTTPResolver(&http.Client{
+var defaultHTTPClient = &http.Client{
 	Timeout: time.Duration(10 * time.Second),
-})
+}
 
-const maxBodyLength = 10 * 1024 * 1024
+// HTTPResolver is the default HTTP resolver. It refuses to connect to
+// private networks.
+var HTTPResolver = NewHTTPResolverWithOptions(HTTPOptions{
+	Timeout: 10 * time.Second,
+})
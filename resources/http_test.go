@@ -1,11 +1,18 @@
 package resources_test
 
 import (
+	"bytes"
+	"context"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -17,6 +24,8 @@ func TestHTTPResolver_valid(t *testing.T) {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/foo.png", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Content-Type", "image/png")
+		w.Header().Add("ETag", `"v1"`)
+		w.Header().Add("Last-Modified", "Tue, 15 Nov 1994 12:45:26 GMT")
 		w.WriteHeader(200)
 		w.Write([]byte("hello"))
 	})
@@ -24,12 +33,64 @@ func TestHTTPResolver_valid(t *testing.T) {
 	defer ts.Close()
 
 	resolver := resources.NewHTTPResolver(http.DefaultClient)
-	r, err := resolver.GetResource(ts.URL + "/foo.png")
+	r, err := resolver.GetResource(context.Background(), ts.URL+"/foo.png")
 	require.NoError(t, err)
+	defer r.Close()
 
 	b, err := ioutil.ReadAll(r)
 	require.NoError(t, err)
 	assert.Equal(t, []byte("hello"), b)
+	assert.Equal(t, int64(5), r.ContentLength)
+	assert.Equal(t, "image/png", r.ContentType)
+	assert.Equal(t, `"v1"`, r.ETag)
+	assert.Equal(t, time.Date(1994, 11, 15, 12, 45, 26, 0, time.UTC), r.LastModified)
+	assert.Equal(t, resources.Validators{
+		ETag:         `"v1"`,
+		LastModified: "Tue, 15 Nov 1994 12:45:26 GMT",
+	}, r.Validators())
+}
+
+func TestHTTPResolver_large(t *testing.T) {
+	body := make([]byte, resources.DefaultMaxBodyLength)
+	for i := range body {
+		body[i] = byte(i)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/exact.tif", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	})
+	mux.HandleFunc("/declared.tif", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)+1))
+		w.Write(body)
+		w.Write([]byte{0})
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	resolver := resources.NewHTTPResolver(http.DefaultClient)
+	r, err := resolver.GetResource(context.Background(), ts.URL+"/exact.tif")
+	require.NoError(t, err)
+	defer r.Close()
+	assert.Equal(t, int64(len(body)), r.ContentLength)
+	b, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(body, b))
+
+	_, err = resolver.GetResource(context.Background(), ts.URL+"/declared.tif")
+	assert.Equal(t, resources.TooLarge{
+		Identifier: ts.URL + "/declared.tif",
+		Limit:      resources.DefaultMaxBodyLength,
+	}, err)
+
+	resolver = resources.NewHTTPResolverWithOptions(resources.HTTPOptions{
+		AllowPrivateNetworks: true,
+		MaxBodyLength:        1024,
+	})
+	_, err = resolver.GetResource(context.Background(), ts.URL+"/exact.tif")
+	assert.Equal(t, resources.TooLarge{
+		Identifier: ts.URL + "/exact.tif",
+		Limit:      1024,
+	}, err)
 }
 
 func TestHTTPResolver_fileURL(t *testing.T) {
@@ -40,7 +101,7 @@ func TestHTTPResolver_fileURL(t *testing.T) {
 	url := "file://" + cwd + "/http_test.go"
 
 	resolver := resources.NewHTTPResolver(http.DefaultClient)
-	_, err = resolver.GetResource(url)
+	_, err = resolver.GetResource(context.Background(), url)
 	require.Error(t, err)
 	assert.IsType(t, resources.InvalidIdentifier{}, err)
 	e := err.(resources.InvalidIdentifier)
@@ -50,9 +111,230 @@ func TestHTTPResolver_fileURL(t *testing.T) {
 func TestHTTPResolver_nonHTTPScheme(t *testing.T) {
 	url := "ftp://example.com/"
 	resolver := resources.NewHTTPResolver(http.DefaultClient)
-	_, err := resolver.GetResource(url)
+	_, err := resolver.GetResource(context.Background(), url)
 	require.Error(t, err)
 	assert.IsType(t, resources.InvalidIdentifier{}, err)
 	e := err.(resources.InvalidIdentifier)
 	assert.Equal(t, url, e.Identifier)
 }
+
+func TestHTTPResolverWithOptions_privateNetworks(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer ts.Close()
+
+	resolver := resources.NewHTTPResolverWithOptions(resources.HTTPOptions{})
+	for _, url := range []string{
+		ts.URL + "/foo.png",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://10.0.0.1/foo.png",
+		"http://[::1]/foo.png",
+		"http://0.0.0.0/foo.png",
+	} {
+		_, err := resolver.GetResource(context.Background(), url)
+		require.Error(t, err, url)
+		assert.IsType(t, resources.InvalidIdentifier{}, err, url)
+	}
+
+	resolver = resources.NewHTTPResolverWithOptions(resources.HTTPOptions{AllowPrivateNetworks: true})
+	r, err := resolver.GetResource(context.Background(), ts.URL+"/foo.png")
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello"), b)
+}
+
+func TestHTTPResolverWithOptions_proxy(t *testing.T) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("proxied " + r.URL.String()))
+	}))
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	require.NoError(t, err)
+
+	resolver := resources.NewHTTPResolverWithOptions(resources.HTTPOptions{
+		Proxy: func(req *http.Request) (*url.URL, error) {
+			if req.URL.Hostname() != proxyURL.Hostname() {
+				return proxyURL, nil
+			}
+			return nil, nil
+		},
+	})
+
+	// The proxy is on a private network, but it does the fetching
+	r, err := resolver.GetResource(context.Background(), "http://93.184.216.34/foo.png")
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "proxied http://93.184.216.34/foo.png", string(b))
+
+	// Its address is still refused for requests that don't go through it
+	_, err = resolver.GetResource(context.Background(), proxy.URL+"/foo.png")
+	assert.IsType(t, resources.InvalidIdentifier{}, err)
+}
+
+func TestHTTPResolverWithOptions_proxyPrivateTarget(t *testing.T) {
+	var proxied int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&proxied, 1)
+		w.Write([]byte("proxied " + r.URL.String()))
+	}))
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	require.NoError(t, err)
+
+	resolver := resources.NewHTTPResolverWithOptions(resources.HTTPOptions{
+		Proxy: http.ProxyURL(proxyURL),
+	})
+	for _, u := range []string{
+		"http://127.0.0.1/foo.png",
+		"http://localhost/foo.png",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://[::1]/foo.png",
+	} {
+		_, err := resolver.GetResource(context.Background(), u)
+		assert.IsType(t, resources.InvalidIdentifier{}, err, u)
+	}
+	assert.Equal(t, int32(0), atomic.LoadInt32(&proxied))
+}
+
+func TestHTTPResolverWithOptions_hosts(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "http://localhost"+r.Host[strings.LastIndex(r.Host, ":"):]+"/foo.png", http.StatusFound)
+			return
+		}
+		w.Write([]byte("hello"))
+	}))
+	defer ts.Close()
+
+	for _, test := range []struct {
+		allowed, denied []string
+		path            string
+		ok              bool
+	}{
+		{nil, nil, "/foo.png", true},
+		{[]string{"127.0.0.1"}, nil, "/foo.png", true},
+		{[]string{"example.com", "*.example.com"}, nil, "/foo.png", false},
+		{nil, []string{"127.0.0.1"}, "/foo.png", false},
+		{nil, []string{"LOCALHOST"}, "/redirect", false},
+		{[]string{"127.0.0.1"}, nil, "/redirect", false},
+		{[]string{"127.0.0.1", "localhost"}, nil, "/redirect", true},
+	} {
+		resolver := resources.NewHTTPResolverWithOptions(resources.HTTPOptions{
+			AllowedHosts:         test.allowed,
+			DeniedHosts:          test.denied,
+			AllowPrivateNetworks: true,
+		})
+		_, err := resolver.GetResource(context.Background(), ts.URL+test.path)
+		if test.ok {
+			assert.NoError(t, err, "%v", test)
+		} else if assert.Error(t, err, "%v", test) {
+			assert.IsType(t, resources.InvalidIdentifier{}, err, "%v", test)
+		}
+	}
+}
+
+func TestHTTPResolver_errors(t *testing.T) {
+	mux := http.NewServeMux()
+	for path, status := range map[string]int{
+		"/missing.png":     http.StatusNotFound,
+		"/gone.png":        http.StatusGone,
+		"/forbidden.png":   http.StatusForbidden,
+		"/broken.png":      http.StatusInternalServerError,
+		"/unavailable.png": http.StatusServiceUnavailable,
+	} {
+		status := status
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		})
+	}
+	mux.HandleFunc("/large.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 11*1024*1024))
+	})
+	mux.HandleFunc("/slow.png", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	resolver := resources.NewHTTPResolver(&http.Client{Timeout: 100 * time.Millisecond})
+	for path, expected := range map[string]error{
+		"/missing.png":   resources.NotFound{Identifier: ts.URL + "/missing.png"},
+		"/gone.png":      resources.NotFound{Identifier: ts.URL + "/gone.png"},
+		"/forbidden.png": resources.Forbidden{Identifier: ts.URL + "/forbidden.png"},
+		"/large.png":     resources.TooLarge{Identifier: ts.URL + "/large.png", Limit: 10 * 1024 * 1024},
+	} {
+		_, err := resolver.GetResource(context.Background(), ts.URL+path)
+		assert.Equal(t, expected, err, path)
+	}
+
+	for path, status := range map[string]int{
+		"/broken.png":      http.StatusInternalServerError,
+		"/unavailable.png": http.StatusServiceUnavailable,
+	} {
+		_, err := resolver.GetResource(context.Background(), ts.URL+path)
+		if assert.IsType(t, resources.Unavailable{}, err, path) {
+			assert.Equal(t, status, err.(resources.Unavailable).StatusCode, path)
+		}
+	}
+
+	_, err := resolver.GetResource(context.Background(), ts.URL+"/slow.png")
+	if assert.IsType(t, resources.Unavailable{}, err) {
+		assert.True(t, err.(resources.Unavailable).Timeout)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = resolver.GetResource(ctx, ts.URL+"/slow.png")
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestHTTPResolverWithOptions_retries(t *testing.T) {
+	var requests int32
+	failures := map[string]int32{"/flaky.png": 2, "/reset.png": 1, "/down.png": 100}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&requests, 1)
+		switch {
+		case r.URL.Path == "/broken.png":
+			w.WriteHeader(http.StatusInternalServerError)
+		case r.URL.Path == "/reset.png" && n <= failures[r.URL.Path]:
+			conn, _, err := w.(http.Hijacker).Hijack()
+			require.NoError(t, err)
+			conn.Close()
+		case n <= failures[r.URL.Path]:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.Write([]byte("hello"))
+		}
+	}))
+	defer ts.Close()
+
+	resolver := resources.NewHTTPResolverWithOptions(resources.HTTPOptions{
+		AllowPrivateNetworks: true,
+		Retries:              2,
+		RetryBackoff:         time.Millisecond,
+	})
+	for _, test := range []struct {
+		path     string
+		ok       bool
+		requests int32
+	}{
+		{"/flaky.png", true, 3},
+		{"/reset.png", true, 2},
+		{"/down.png", false, 3},
+		{"/broken.png", false, 1},
+	} {
+		atomic.StoreInt32(&requests, 0)
+		r, err := resolver.GetResource(context.Background(), ts.URL+test.path)
+		if test.ok {
+			if assert.NoError(t, err, test.path) {
+				r.Close()
+			}
+		} else {
+			assert.IsType(t, resources.Unavailable{}, err, test.path)
+		}
+		assert.Equal(t, test.requests, atomic.LoadInt32(&requests), test.path)
+	}
+}
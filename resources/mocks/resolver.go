@@ -1,6 +1,6 @@
 package mocks
 
-import io "io"
+import context "context"
 import mock "github.com/stretchr/testify/mock"
 import resources "github.com/t11e/picaxe/resources"
 
@@ -9,22 +9,22 @@ type Resolver struct {
 	mock.Mock
 }
 
-// GetResource provides a mock function with given fields: identifier
-func (_m *Resolver) GetResource(identifier string) (io.ReadSeeker, error) {
-	ret := _m.Called(identifier)
+// GetResource provides a mock function with given fields: ctx, identifier
+func (_m *Resolver) GetResource(ctx context.Context, identifier string) (*resources.Resource, error) {
+	ret := _m.Called(ctx, identifier)
 
-	var r0 io.ReadSeeker
-	if rf, ok := ret.Get(0).(func(string) io.ReadSeeker); ok {
-		r0 = rf(identifier)
+	var r0 *resources.Resource
+	if rf, ok := ret.Get(0).(func(context.Context, string) *resources.Resource); ok {
+		r0 = rf(ctx, identifier)
 	} else {
 		if ret.Get(0) != nil {
-			r0 = ret.Get(0).(io.ReadSeeker)
+			r0 = ret.Get(0).(*resources.Resource)
 		}
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(string) error); ok {
-		r1 = rf(identifier)
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, identifier)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -0,0 +1,169 @@
+package resources
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+)
+
+// DefaultMaxBodyLength is the largest resource that resolvers download,
+// unless configured otherwise.
+const DefaultMaxBodyLength = 10 * 1024 * 1024
+
+// maxMemoryBodyLength is the largest body kept in memory. Larger bodies
+// are written to a temporary file.
+const maxMemoryBodyLength = 1024 * 1024
+
+// Resource is the content of a resource, and what is known about it. It
+// must be closed after use.
+type Resource struct {
+	io.ReadSeeker
+
+	// ContentLength is the size of the content in bytes.
+	ContentLength int64
+
+	// ContentType is the media type given by the origin, if any.
+	ContentType string
+
+	// LastModified is when the origin says the resource last changed, if
+	// known.
+	LastModified time.Time
+
+	// ETag is the entity tag given by the origin, if any.
+	ETag string
+
+	close func() error
+}
+
+// NewResource returns a resource whose content is held in memory.
+func NewResource(body []byte) *Resource {
+	return &Resource{
+		ReadSeeker:    bytes.NewReader(body),
+		ContentLength: int64(len(body)),
+	}
+}
+
+// newFileResource returns a resource whose content is read from a file,
+// calling close when the resource is closed.
+func newFileResource(f *os.File, close func() error) (*Resource, error) {
+	info, err := f.Stat()
+	if err != nil {
+		close()
+		return nil, err
+	}
+	return &Resource{
+		ReadSeeker:    f,
+		ContentLength: info.Size(),
+		close:         close,
+	}, nil
+}
+
+// Close releases the content, such as an open or temporary file.
+func (r *Resource) Close() error {
+	if r.close == nil {
+		return nil
+	}
+	return r.close()
+}
+
+// Validators returns the validators of the resource's current version.
+func (r *Resource) Validators() Validators {
+	v := Validators{ETag: r.ETag}
+	if !r.LastModified.IsZero() {
+		v.LastModified = r.LastModified.UTC().Format(http.TimeFormat)
+	}
+	return v
+}
+
+// readBody reads a response body, up to maxLength bytes, into a resource
+// along with the metadata given by the response headers.
+func readBody(
+	ctx context.Context,
+	resp *http.Response,
+	identifier string,
+	maxLength int64) (*Resource, error) {
+	if resp.ContentLength > maxLength {
+		return nil, TooLarge{Identifier: identifier, Limit: maxLength}
+	}
+
+	body := &bodyReader{r: resp.Body}
+	r, err := readResource(body, maxLength)
+	if err != nil {
+		if body.err != nil {
+			return nil, requestError(ctx, identifier, body.err)
+		}
+		if err == errTooLarge {
+			return nil, TooLarge{Identifier: identifier, Limit: maxLength}
+		}
+		return nil, err
+	}
+
+	r.ContentType = resp.Header.Get("Content-Type")
+	r.ETag = resp.Header.Get("ETag")
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		r.LastModified = t
+	}
+	return r, nil
+}
+
+var errTooLarge = errors.New("resource too large")
+
+// readResource reads up to maxLength bytes into a resource, returning
+// errTooLarge if there are more. Small content is kept in memory, and
+// larger content in a temporary file that is removed when the resource is
+// closed.
+func readResource(r io.Reader, maxLength int64) (*Resource, error) {
+	head, err := ioutil.ReadAll(io.LimitReader(r, maxMemoryBodyLength+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(head)) > maxLength {
+		return nil, errTooLarge
+	}
+	if len(head) <= maxMemoryBodyLength {
+		return NewResource(head), nil
+	}
+
+	f, err := ioutil.TempFile("", "picaxe-")
+	if err != nil {
+		return nil, err
+	}
+	remove := func() error {
+		err := f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+
+	n, err := io.Copy(f, io.MultiReader(bytes.NewReader(head), io.LimitReader(r, maxLength+1-int64(len(head)))))
+	if err == nil && n > maxLength {
+		err = errTooLarge
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		remove()
+		return nil, err
+	}
+	return newFileResource(f, remove)
+}
+
+// bodyReader remembers the error from reading a body, to tell it apart
+// from errors writing the body somewhere.
+type bodyReader struct {
+	r   io.Reader
+	err error
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
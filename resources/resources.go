@@ -1,8 +1,10 @@
 package resources
 
 import (
+	"context"
 	"fmt"
-	"io"
+	"net"
+	"net/http"
 )
 
 //go:generate sh -c "mockery -name='Resolver' -case=underscore"
@@ -17,8 +19,91 @@ func (err InvalidIdentifier) Error() string {
 	return fmt.Sprintf("invalid identifier %q: %s", err.Identifier, err.Message)
 }
 
+// NotFound is returned when the resource for an identifier does not exist.
+type NotFound struct {
+	Identifier string
+}
+
+// Error implements interface "error".
+func (err NotFound) Error() string {
+	return fmt.Sprintf("resource %q not found", err.Identifier)
+}
+
+// Forbidden is returned when access to the resource for an identifier is
+// denied.
+type Forbidden struct {
+	Identifier string
+}
+
+// Error implements interface "error".
+func (err Forbidden) Error() string {
+	return fmt.Sprintf("access to resource %q is forbidden", err.Identifier)
+}
+
+// TooLarge is returned when a resource is larger than the resolver accepts.
+type TooLarge struct {
+	Identifier string
+	Limit      int64
+}
+
+// Error implements interface "error".
+func (err TooLarge) Error() string {
+	return fmt.Sprintf("resource %q is larger than %d bytes", err.Identifier, err.Limit)
+}
+
+// Unavailable is returned when a resource could not be retrieved because
+// the server it comes from failed, or could not be reached.
+type Unavailable struct {
+	Identifier string
+	Message    string
+
+	// StatusCode is the HTTP status code returned by the server, if any.
+	StatusCode int
+
+	// Timeout is true if the server did not respond in time.
+	Timeout bool
+}
+
+// Error implements interface "error".
+func (err Unavailable) Error() string {
+	return fmt.Sprintf("resource %q is unavailable: %s", err.Identifier, err.Message)
+}
+
+// statusError returns the error for an unsuccessful HTTP response status.
+func statusError(identifier string, resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusNotFound, http.StatusGone:
+		return NotFound{Identifier: identifier}
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return Forbidden{Identifier: identifier}
+	}
+	return Unavailable{
+		Identifier: identifier,
+		Message:    fmt.Sprintf("failed with HTTP status %s", resp.Status),
+		StatusCode: resp.StatusCode,
+	}
+}
+
+// requestError returns the error for a failed HTTP request. Errors caused
+// by the context are returned as is.
+func requestError(ctx context.Context, identifier string, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	e := Unavailable{
+		Identifier: identifier,
+		Message:    err.Error(),
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		e.Timeout = true
+	}
+	return e
+}
+
 // Resolver is an interface for something that can resolve a resource
 // to a byte stream by its identifier.
 type Resolver interface {
-	GetResource(identifier string) (io.ReadSeeker, error)
+	// GetResource returns the resource for an identifier. The caller must
+	// close it.
+	GetResource(ctx context.Context, identifier string) (*Resource, error)
 }
@@ -0,0 +1,157 @@
+package resources
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// S3Options configures a resolver created by NewS3Resolver.
+type S3Options struct {
+	// Endpoint is the base URL of the S3-compatible service, such as
+	// "http://localhost:9000". It defaults to the AWS endpoint of Region.
+	Endpoint string
+
+	// Region is the region that requests are signed for. It defaults to
+	// "us-east-1".
+	Region string
+
+	// Credentials used to sign requests. Requests are sent unsigned if the
+	// access key ID is empty.
+	Credentials Credentials
+
+	// PathStyle selects path-style URLs (http://host/bucket/key) instead of
+	// virtual-hosted-style URLs (http://bucket.host/key).
+	PathStyle bool
+
+	// Client is the HTTP client used for requests. It defaults to
+	// http.DefaultClient.
+	Client *http.Client
+
+	// MaxBodyLength is the largest object that is downloaded. It defaults
+	// to DefaultMaxBodyLength.
+	MaxBodyLength int64
+}
+
+type s3Resolver struct {
+	endpoint      *url.URL
+	region        string
+	credentials   Credentials
+	pathStyle     bool
+	client        *http.Client
+	maxBodyLength int64
+}
+
+// NewS3Resolver returns a resource resolver that downloads objects from
+// S3-compatible object storage. Identifiers are of the form "bucket/key".
+func NewS3Resolver(opts S3Options) (Resolver, error) {
+	if opts.Region == "" {
+		opts.Region = "us-east-1"
+	}
+	if opts.Endpoint == "" {
+		opts.Endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", opts.Region)
+	}
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	if opts.MaxBodyLength == 0 {
+		opts.MaxBodyLength = DefaultMaxBodyLength
+	}
+
+	endpoint, err := url.Parse(opts.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint %q: %s", opts.Endpoint, err)
+	}
+	if !(endpoint.Scheme == "http" || endpoint.Scheme == "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", opts.Endpoint)
+	}
+
+	return &s3Resolver{
+		endpoint:      endpoint,
+		region:        opts.Region,
+		credentials:   opts.Credentials,
+		pathStyle:     opts.PathStyle,
+		client:        opts.Client,
+		maxBodyLength: opts.MaxBodyLength,
+	}, nil
+}
+
+// GetResource implements interface Resolver.
+func (s s3Resolver) GetResource(ctx context.Context, identifier string) (*Resource, error) {
+	return s.GetResourceIfModified(ctx, identifier, Validators{})
+}
+
+// GetResourceIfModified implements interface ConditionalResolver.
+func (s s3Resolver) GetResourceIfModified(
+	ctx context.Context,
+	identifier string,
+	validators Validators) (*Resource, error) {
+	u, err := s.objectURL(identifier)
+	if err != nil {
+		return nil, InvalidIdentifier{
+			Message:    err.Error(),
+			Identifier: identifier,
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	setConditionalHeaders(req, validators)
+	if s.credentials.AccessKeyID != "" {
+		signV4(req, s.credentials, s.region, "s3", time.Now())
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, requestError(ctx, identifier, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && !validators.IsZero() {
+		return nil, ErrNotModified
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError(identifier, resp)
+	}
+
+	return readBody(ctx, resp, identifier, s.maxBodyLength)
+}
+
+var s3BucketRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9.\-]{1,61}[a-z0-9]$`)
+
+// objectURL returns the URL of the object identified by "bucket/key".
+func (s s3Resolver) objectURL(identifier string) (*url.URL, error) {
+	parts := strings.SplitN(identifier, "/", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, errors.New("not of the form bucket/key")
+	}
+	bucket, key := parts[0], parts[1]
+	if !s3BucketRegexp.MatchString(bucket) {
+		return nil, fmt.Errorf("not a valid bucket name: %q", bucket)
+	}
+	// The endpoint, or a proxy in front of it, may normalize these away,
+	// and fetch something other than what was signed for
+	for _, segment := range strings.Split(key, "/") {
+		switch segment {
+		case "", ".", "..":
+			return nil, fmt.Errorf("not a valid key: %q", key)
+		}
+	}
+
+	u := *s.endpoint
+	basePath := strings.TrimSuffix(u.Path, "/")
+	if s.pathStyle {
+		u.Path = basePath + "/" + bucket + "/" + key
+	} else {
+		u.Host = bucket + "." + u.Host
+		u.Path = basePath + "/" + key
+	}
+	u.RawPath = awsURIEscape(u.Path)
+	return &u, nil
+}
@@ -0,0 +1,209 @@
+package resources
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// blockedError is returned when fetching from a host or address that is
+// not allowed.
+type blockedError struct {
+	host string
+}
+
+// Error implements interface "error".
+func (err blockedError) Error() string {
+	return fmt.Sprintf("host %q is not allowed", err.host)
+}
+
+// blockedCause returns the blockedError that caused an error from an HTTP
+// client, if any.
+func blockedCause(err error) (blockedError, bool) {
+	for {
+		switch e := err.(type) {
+		case blockedError:
+			return e, true
+		case *url.Error:
+			err = e.Err
+		case *net.OpError:
+			err = e.Err
+		case *os.SyscallError:
+			err = e.Err
+		default:
+			return blockedError{}, false
+		}
+	}
+}
+
+// matchHost returns whether a host name matches any of the patterns. A
+// pattern of the form "*.example.com" matches subdomains of example.com;
+// other patterns must match exactly. Matching ignores case.
+func matchHost(host string, patterns []string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if strings.HasPrefix(pattern, "*.") {
+			if strings.HasSuffix(host, pattern[1:]) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// privateNetworks lists the address ranges that are blocked unless private
+// networks are allowed: private, shared, loopback, link-local and
+// unspecified addresses.
+var privateNetworks = mustParseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+)
+
+func isPrivateIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyAddrs remembers the addresses of the proxies that requests are
+// sent through, so that connections to them can be allowed even though
+// proxies are usually on private networks.
+type proxyAddrs struct {
+	addrs sync.Map
+}
+
+// record wraps a proxy function to remember the proxies it returns, and
+// to refuse requests made to them directly rather than through them.
+// Since a proxy connects to the origin itself, requests are only sent
+// through it if the origin's host resolves to public addresses. The
+// proxies for plain HTTP and HTTPS requests are remembered right away.
+func (p *proxyAddrs) record(
+	proxy func(*http.Request) (*url.URL, error)) func(*http.Request) (*url.URL, error) {
+	for _, u := range []string{"http://picaxe.invalid/", "https://picaxe.invalid/"} {
+		if req, err := http.NewRequest("GET", u, nil); err == nil {
+			if u, err := proxy(req); err == nil && u != nil {
+				p.addrs.Store(dialAddr(u), true)
+			}
+		}
+	}
+	return func(req *http.Request) (*url.URL, error) {
+		u, err := proxy(req)
+		if err != nil {
+			return nil, err
+		}
+		if u != nil {
+			if err := checkPublicHost(req.Context(), req.URL.Hostname()); err != nil {
+				return nil, err
+			}
+			p.addrs.Store(dialAddr(u), true)
+			return u, nil
+		}
+		if _, ok := p.addrs.Load(dialAddr(req.URL)); ok {
+			return nil, blockedError{host: req.URL.Hostname()}
+		}
+		return nil, nil
+	}
+}
+
+// checkPublicHost returns blockedError unless all the addresses of a host
+// are public. Unlike blockPrivateAddresses, this can be got around by DNS
+// rebinding, since the proxy resolves the host again.
+func checkPublicHost(ctx context.Context, host string) error {
+	if ip := net.ParseIP(host); ip != nil {
+		if isPrivateIP(ip) {
+			return blockedError{host: host}
+		}
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if isPrivateIP(addr.IP) {
+			return blockedError{host: host}
+		}
+	}
+	return nil
+}
+
+// dialContext returns a dial function that connects to recorded proxies
+// with dialer, and to other addresses only if they are public.
+func (p *proxyAddrs) dialContext(
+	dialer *net.Dialer) func(ctx context.Context, network, address string) (net.Conn, error) {
+	restricted := *dialer
+	restricted.Control = blockPrivateAddresses
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		if _, ok := p.addrs.Load(address); ok {
+			return dialer.DialContext(ctx, network, address)
+		}
+		return restricted.DialContext(ctx, network, address)
+	}
+}
+
+// dialAddr returns the address that http.Transport dials to connect to a
+// URL's host, or to a proxy.
+func dialAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		switch u.Scheme {
+		case "https":
+			port = "443"
+		case "socks5":
+			port = "1080"
+		default:
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// blockPrivateAddresses is a net.Dialer control function that refuses to
+// connect to private addresses. Checking the address being dialed, rather
+// than the host name, means that DNS rebinding can't get around it.
+func blockPrivateAddresses(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || isPrivateIP(ip) {
+		return blockedError{host: host}
+	}
+	return nil
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = network
+	}
+	return networks
+}
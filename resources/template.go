@@ -0,0 +1,93 @@
+package resources
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// TemplateIDPlaceholder is replaced by the identifier in URL templates.
+const TemplateIDPlaceholder = "{id}"
+
+// DefaultIDPattern matches identifiers made of letters, digits, dots,
+// dashes and underscores.
+var DefaultIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+type templateResolver struct {
+	http     httpResolver
+	template string
+	pattern  *regexp.Regexp
+}
+
+// NewTemplateResolver returns a resource resolver that downloads the URL
+// made by replacing "{id}" in template with the identifier, such as
+// "https://origin.internal/masters/{id}.jpg". Identifiers must match
+// pattern in full; if it is nil, DefaultIDPattern is used.
+func NewTemplateResolver(template string, pattern *regexp.Regexp, client *http.Client) (Resolver, error) {
+	return newTemplateResolver(template, pattern, httpResolver{
+		client:        client,
+		maxBodyLength: DefaultMaxBodyLength,
+	})
+}
+
+func newTemplateResolver(template string, pattern *regexp.Regexp, h httpResolver) (Resolver, error) {
+	if !strings.Contains(template, TemplateIDPlaceholder) {
+		return nil, fmt.Errorf("URL template %q does not contain %s", template, TemplateIDPlaceholder)
+	}
+	u, err := url.Parse(strings.Replace(template, TemplateIDPlaceholder, "id", -1))
+	if err != nil || !(u.Scheme == "http" || u.Scheme == "https") || u.Host == "" {
+		return nil, fmt.Errorf("not a valid URL template: %q", template)
+	}
+	if pattern == nil {
+		pattern = DefaultIDPattern
+	}
+	// Anchoring the pattern makes it match the whole identifier if it can,
+	// rather than stopping at the leftmost match, as in "a|ab"
+	anchored, err := regexp.Compile(`^(?:` + pattern.String() + `)$`)
+	if err != nil {
+		return nil, fmt.Errorf("not a valid identifier pattern: %q", pattern)
+	}
+	return &templateResolver{
+		http:     h,
+		template: template,
+		pattern:  anchored,
+	}, nil
+}
+
+// GetResource implements interface Resolver.
+func (t templateResolver) GetResource(ctx context.Context, identifier string) (*Resource, error) {
+	return t.GetResourceIfModified(ctx, identifier, Validators{})
+}
+
+// GetResourceIfModified implements interface ConditionalResolver.
+func (t templateResolver) GetResourceIfModified(
+	ctx context.Context,
+	identifier string,
+	validators Validators) (*Resource, error) {
+	if err := t.validateIdentifier(identifier); err != nil {
+		return nil, InvalidIdentifier{
+			Message:    err.Error(),
+			Identifier: identifier,
+		}
+	}
+
+	escaped := (&url.URL{Path: identifier}).EscapedPath()
+	u := strings.Replace(t.template, TemplateIDPlaceholder, escaped, -1)
+	return t.http.fetch(ctx, identifier, u, validators)
+}
+
+func (t templateResolver) validateIdentifier(identifier string) error {
+	if !t.pattern.MatchString(identifier) {
+		return errors.New("does not match pattern")
+	}
+	for _, elem := range strings.Split(identifier, "/") {
+		if elem == "." || elem == ".." {
+			return fmt.Errorf("contains %q", elem)
+		}
+	}
+	return nil
+}
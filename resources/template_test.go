@@ -0,0 +1,87 @@
+package resources_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/t11e/picaxe/resources"
+)
+
+func TestTemplateResolver(t *testing.T) {
+	var path string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.EscapedPath()
+		assert.Equal(t, "1", r.Header.Get(resources.HTTPHeaderPixace))
+		w.Write([]byte("hello"))
+	}))
+	defer ts.Close()
+
+	resolver, err := resources.NewTemplateResolver(ts.URL+"/masters/{id}.jpg", nil, http.DefaultClient)
+	require.NoError(t, err)
+
+	r, err := resolver.GetResource(context.Background(), "abc-123_x.y")
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello"), b)
+	assert.Equal(t, "/masters/abc-123_x.y.jpg", path)
+
+	for _, identifier := range []string{"", "..", "a/b", "a b", "http://example.com/", "abc\n"} {
+		_, err := resolver.GetResource(context.Background(), identifier)
+		require.Error(t, err, identifier)
+		assert.IsType(t, resources.InvalidIdentifier{}, err, identifier)
+	}
+}
+
+func TestTemplateResolver_pattern(t *testing.T) {
+	resolver, err := resources.NewTemplateResolver("https://example.com/{id}",
+		regexp.MustCompile(`[0-9]+`), http.DefaultClient)
+	require.NoError(t, err)
+
+	// The pattern must match the whole identifier
+	_, err = resolver.GetResource(context.Background(), "123abc")
+	require.Error(t, err)
+	assert.IsType(t, resources.InvalidIdentifier{}, err)
+}
+
+func TestTemplateResolver_patternAlternatives(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer ts.Close()
+
+	resolver, err := resources.NewTemplateResolver(ts.URL+"/{id}",
+		regexp.MustCompile(`a|ab`), http.DefaultClient)
+	require.NoError(t, err)
+
+	// Any alternative may match the whole identifier, not just the leftmost
+	for _, identifier := range []string{"a", "ab"} {
+		r, err := resolver.GetResource(context.Background(), identifier)
+		require.NoError(t, err, identifier)
+		body, err := ioutil.ReadAll(r)
+		r.Close()
+		require.NoError(t, err)
+		assert.Equal(t, "/"+identifier, string(body))
+	}
+
+	_, err = resolver.GetResource(context.Background(), "abc")
+	assert.IsType(t, resources.InvalidIdentifier{}, err)
+}
+
+func TestNewTemplateResolver_invalid(t *testing.T) {
+	for _, template := range []string{
+		"https://example.com/masters/foo.jpg",
+		"ftp://example.com/{id}",
+		"/masters/{id}",
+	} {
+		_, err := resources.NewTemplateResolver(template, nil, http.DefaultClient)
+		assert.Error(t, err, template)
+	}
+}
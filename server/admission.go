@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// overloadedError is returned when a request can't be processed because
+// too many are being processed already.
+type overloadedError struct {
+	retryAfter time.Duration
+}
+
+// Error implements interface "error".
+func (err overloadedError) Error() string {
+	return fmt.Sprintf("too busy, retry after %s", err.retryAfter)
+}
+
+// admission limits how many images are processed at once. Requests beyond
+// the limit wait in a queue of limited length, for a limited time.
+type admission struct {
+	slots    chan struct{}
+	maxQueue int
+	maxWait  time.Duration
+
+	mu    sync.Mutex
+	stats admissionStats
+}
+
+// admissionStats describe the load on the server.
+type admissionStats struct {
+	// Processing is the number of images being processed.
+	Processing int `json:"processing"`
+
+	// Queued is the number of requests waiting for their turn.
+	Queued int `json:"queued"`
+
+	// Admitted and Rejected count the requests that were or weren't given
+	// a turn.
+	Admitted int64 `json:"admitted"`
+	Rejected int64 `json:"rejected"`
+
+	// TotalWaitSeconds is the time that admitted requests spent queued.
+	TotalWaitSeconds float64 `json:"totalWaitSeconds"`
+}
+
+// newAdmission returns an admission that lets maxProcessing requests be
+// processed at once, or any number if it is zero.
+func newAdmission(maxProcessing, maxQueue int, maxWait time.Duration) *admission {
+	a := &admission{
+		maxQueue: maxQueue,
+		maxWait:  maxWait,
+	}
+	if maxProcessing > 0 {
+		a.slots = make(chan struct{}, maxProcessing)
+	}
+	return a
+}
+
+// acquire waits for a turn to process an image, and returns a function to
+// call when done. It fails with overloadedError if the queue is full, or
+// the wait is too long.
+func (a *admission) acquire(ctx context.Context) (func(), error) {
+	if a.slots == nil {
+		a.admit(0)
+		return a.release, nil
+	}
+	select {
+	case a.slots <- struct{}{}:
+		a.admit(0)
+		return a.release, nil
+	default:
+	}
+
+	a.mu.Lock()
+	if a.stats.Queued >= a.maxQueue {
+		a.stats.Rejected++
+		a.mu.Unlock()
+		return nil, a.overloaded()
+	}
+	a.stats.Queued++
+	a.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if a.maxWait > 0 {
+		timer := time.NewTimer(a.maxWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	start := time.Now()
+	select {
+	case a.slots <- struct{}{}:
+		a.mu.Lock()
+		a.stats.Queued--
+		a.mu.Unlock()
+		a.admit(time.Since(start))
+		return a.release, nil
+	case <-timeout:
+		a.mu.Lock()
+		a.stats.Queued--
+		a.stats.Rejected++
+		a.mu.Unlock()
+		return nil, a.overloaded()
+	case <-ctx.Done():
+		a.mu.Lock()
+		a.stats.Queued--
+		a.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+func (a *admission) admit(wait time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.stats.Processing++
+	a.stats.Admitted++
+	a.stats.TotalWaitSeconds += wait.Seconds()
+}
+
+func (a *admission) release() {
+	a.mu.Lock()
+	a.stats.Processing--
+	a.mu.Unlock()
+	if a.slots != nil {
+		<-a.slots
+	}
+}
+
+// overloaded returns the error for a request that wasn't admitted. Clients
+// are told to retry after about as long as a request may be queued.
+func (a *admission) overloaded() error {
+	retryAfter := a.maxWait
+	if retryAfter < time.Second {
+		retryAfter = time.Second
+	}
+	return overloadedError{retryAfter: retryAfter}
+}
+
+func (a *admission) snapshot() admissionStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.stats
+}
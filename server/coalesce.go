@@ -0,0 +1,174 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+
+	"github.com/t11e/picaxe/derivatives"
+)
+
+// renderGroup runs identical renders that are requested at the same time
+// only once, sharing the result.
+type renderGroup struct {
+	mu    sync.Mutex
+	calls map[string]*renderCall
+}
+
+// renderCall is a render in progress.
+type renderCall struct {
+	done    chan struct{}
+	waiters int
+	cancel  context.CancelFunc
+	d       *derivatives.Derivative
+	err     error
+}
+
+// errDetached is the result of a render whose output went only to the
+// caller that started it, so others must render for themselves.
+var errDetached = errors.New("render detached")
+
+func newRenderGroup() *renderGroup {
+	return &renderGroup{calls: map[string]*renderCall{}}
+}
+
+// do returns the result of render, calling it unless a render with the
+// same key is already in progress. The render has its own context, so that
+// it carries on if the caller that started it goes away; it is only
+// canceled once every caller waiting for it has gone, or when the deadline
+// of the caller that started it passes.
+func (g *renderGroup) do(
+	ctx context.Context,
+	key string,
+	render func(ctx context.Context) (*derivatives.Derivative, error)) (*derivatives.Derivative, error) {
+	g.mu.Lock()
+	call, ok := g.calls[key]
+	if !ok {
+		var renderCtx context.Context
+		var cancel context.CancelFunc
+		if deadline, ok := ctx.Deadline(); ok {
+			renderCtx, cancel = context.WithDeadline(context.Background(), deadline)
+		} else {
+			renderCtx, cancel = context.WithCancel(context.Background())
+		}
+		call = &renderCall{done: make(chan struct{}), cancel: cancel}
+		g.calls[key] = call
+
+		go func() {
+			d, err := renderSafely(renderCtx, render)
+
+			g.mu.Lock()
+			if g.calls[key] == call {
+				delete(g.calls, key)
+			}
+			g.mu.Unlock()
+			call.d, call.err = d, err
+			cancel()
+			close(call.done)
+		}()
+	}
+	call.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.d, call.err
+	case <-ctx.Done():
+		g.mu.Lock()
+		call.waiters--
+		if call.waiters == 0 {
+			// No one wants the result any more, including anyone who
+			// asks for it from now on
+			call.cancel()
+			if g.calls[key] == call {
+				delete(g.calls, key)
+			}
+		}
+		g.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// doStreaming is like do, except that a render that isn't already in
+// progress runs in the calling goroutine with the caller's context, so
+// that it can stream its output to the caller's response. Before it does
+// so, the render must call detach, after which callers waiting for it, and
+// those arriving later, render for themselves. They do the same if the
+// caller that started the render goes away.
+func (g *renderGroup) doStreaming(
+	ctx context.Context,
+	key string,
+	render func(ctx context.Context, detach func()) (*derivatives.Derivative, error)) (*derivatives.Derivative, error) {
+	for {
+		g.mu.Lock()
+		call, ok := g.calls[key]
+		if !ok {
+			call = &renderCall{done: make(chan struct{}), cancel: func() {}}
+			g.calls[key] = call
+			g.mu.Unlock()
+			return g.renderInline(ctx, key, call, render)
+		}
+		g.mu.Unlock()
+
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		switch call.err {
+		case errDetached, context.Canceled, context.DeadlineExceeded:
+			continue
+		}
+		return call.d, call.err
+	}
+}
+
+// renderInline calls render for a call registered by doStreaming, and
+// hands its result to the callers waiting for it, unless it was detached.
+func (g *renderGroup) renderInline(
+	ctx context.Context,
+	key string,
+	call *renderCall,
+	render func(ctx context.Context, detach func()) (*derivatives.Derivative, error)) (*derivatives.Derivative, error) {
+	var once sync.Once
+	finish := func(d *derivatives.Derivative, err error) {
+		once.Do(func() {
+			g.mu.Lock()
+			if g.calls[key] == call {
+				delete(g.calls, key)
+			}
+			g.mu.Unlock()
+			call.d, call.err = d, err
+			close(call.done)
+		})
+	}
+
+	// Waiters must not wait forever if render panics
+	finished := false
+	defer func() {
+		if !finished {
+			finish(nil, errDetached)
+		}
+	}()
+	d, err := render(ctx, func() { finish(nil, errDetached) })
+	finished = true
+	finish(d, err)
+	return d, err
+}
+
+// renderSafely calls render, turning a panic into an error, since it runs
+// outside of the handler that would otherwise recover from it.
+func renderSafely(
+	ctx context.Context,
+	render func(ctx context.Context) (*derivatives.Derivative, error)) (d *derivatives.Derivative, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("Panic while rendering: %v\n%s", p, debug.Stack())
+			err = fmt.Errorf("panic while rendering: %v", p)
+		}
+	}()
+	return render(ctx)
+}
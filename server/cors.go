@@ -0,0 +1,59 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+)
+
+// corsHandler returns a middleware that adds CORS headers to responses for
+// requests from any of the given origins, and answers preflight requests. An
+// origin of "*" allows all origins. Otherwise every response varies by
+// origin, so that shared caches don't serve a response made for one origin
+// to another.
+func corsHandler(origins []string) func(http.Handler) http.Handler {
+	allowAll := false
+	allowed := make(map[string]bool, len(origins))
+	for _, origin := range origins {
+		if origin == "*" {
+			allowAll = true
+		}
+		allowed[origin] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !allowAll {
+				w.Header().Add("Vary", "Origin")
+			}
+			origin := r.Header.Get("Origin")
+			if origin == "" || !(allowAll || allowed[origin]) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			h := w.Header()
+			if allowAll {
+				h.Set("Access-Control-Allow-Origin", "*")
+			} else {
+				h.Set("Access-Control-Allow-Origin", origin)
+			}
+
+			if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+				h.Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+				if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+					h.Set("Access-Control-Allow-Headers", headers)
+				}
+				h.Set("Access-Control-Max-Age", "86400")
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			h.Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// corsExposedHeaders lists the response headers that cross-origin clients
+// may read, beyond the CORS-safelisted ones.
+var corsExposedHeaders = []string{"ETag", "Link"}
@@ -2,18 +2,23 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
-	"io"
+	"image"
 	"log"
+	"math"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/eemeyer/chi"
 	"github.com/eemeyer/chi/middleware"
+	"github.com/t11e/picaxe/derivatives"
 	"github.com/t11e/picaxe/iiif"
 	"github.com/t11e/picaxe/resources"
 )
@@ -22,16 +27,62 @@ type ServerOptions struct {
 	ResourceResolver resources.Resolver
 	Processor        iiif.Processor
 	MaxAge           time.Duration
+
+	// CanonicalRedirectStatus, if non-zero, is the status code (such as 301
+	// or 302) used to redirect image requests to their canonical form.
+	CanonicalRedirectStatus int
+
+	// Tiling is the tiling advertised in image information documents.
+	Tiling iiif.Tiling
+
+	// CORSOrigins lists the origins allowed to make cross-origin requests.
+	// An origin of "*" allows all origins.
+	CORSOrigins []string
+
+	// DerivativeCache, if set, stores rendered images by their ETag.
+	DerivativeCache derivatives.Cache
+
+	// MaxConcurrentProcesses limits how many images are processed at once.
+	// Zero means no limit.
+	MaxConcurrentProcesses int
+
+	// MaxQueuedProcesses limits how many requests wait for their turn
+	// while MaxConcurrentProcesses images are being processed. Requests
+	// beyond it are refused with status 503.
+	MaxQueuedProcesses int
+
+	// MaxQueueWait is how long a request waits for its turn before it is
+	// refused with status 503. Zero means no limit.
+	MaxQueueWait time.Duration
+
+	// StreamThreshold, if non-zero, makes rendered images larger than this
+	// many bytes be streamed to the client as they are encoded, rather
+	// than buffered. Smaller images are still buffered, and sent with a
+	// Content-Length. Identical requests share a render until it starts
+	// streaming; streamed images are not stored in the derivative cache.
+	StreamThreshold int
 }
 
+// HTTPHeaderCache tells whether an image was served from the derivative
+// cache: "hit" if it was, "miss" if it was rendered.
+const HTTPHeaderCache = "X-Picaxe-Cache"
+
 type Server struct {
 	ServerOptions
 	cacheControlHeader string
+	renders            *renderGroup
+	admission          *admission
 }
 
 func NewServer(opts ServerOptions) *Server {
 	cacheControlHeader := fmt.Sprintf("public,s-maxage=%0.f", opts.MaxAge.Seconds())
-	return &Server{ServerOptions: opts, cacheControlHeader: cacheControlHeader}
+	return &Server{
+		ServerOptions:      opts,
+		cacheControlHeader: cacheControlHeader,
+		renders:            newRenderGroup(),
+		admission: newAdmission(opts.MaxConcurrentProcesses,
+			opts.MaxQueuedProcesses, opts.MaxQueueWait),
+	}
 }
 
 func (s *Server) Run(address string) error {
@@ -49,10 +100,15 @@ func (s *Server) Handler() *chi.Mux {
 	r.Use(middleware.RealIP)
 	r.Use(middleware.Logger)
 	r.Use(middleware.CloseNotify)
-	r.Use(middleware.Recoverer)
+	r.Use(recoverer)
 	r.Use(middleware.Timeout(30 * time.Second))
+	if len(s.CORSOrigins) > 0 {
+		r.Use(corsHandler(s.CORSOrigins))
+	}
 	r.Get("/api/picaxe/ping", s.handlePing)
-	r.Get("/api/picaxe/v1/iiif/*", s.handleImage)
+	r.Get("/api/picaxe/stats", s.handleStats)
+	r.Get("/api/picaxe/v1/iiif/*", s.handleIIIF(iiif.APIVersion2))
+	r.Get("/api/picaxe/v3/iiif/*", s.handleIIIF(iiif.APIVersion3))
 	return r
 }
 
@@ -61,25 +117,89 @@ func (s *Server) handlePing(w http.ResponseWriter, _ *http.Request) {
 	_, _ = w.Write([]byte("picaxe"))
 }
 
-func (s *Server) handleImage(w http.ResponseWriter, r *http.Request) {
-	if r.Header.Get(resources.HTTPHeaderPixace) != "" {
-		log.Printf("Request contains loop-detecting header %q, refusing", resources.HTTPHeaderPixace)
-		writeError(w, http.StatusForbidden, "loop detected")
+// handleStats responds with the load on the server, for monitoring.
+func (s *Server) handleStats(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(s.admission.snapshot())
+}
+
+func (s *Server) handleIIIF(version iiif.APIVersion) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(resources.HTTPHeaderPixace) != "" {
+			log.Printf("Request contains loop-detecting header %q, refusing", resources.HTTPHeaderPixace)
+			writeError(w, http.StatusForbidden, "loop detected")
+			return
+		}
+
+		spec := chi.URLParam(r, "*")
+		if spec != "" && !strings.Contains(spec, "/") {
+			// Base URI, see http://iiif.io/api/image/2.1/#uri-syntax
+			http.Redirect(w, r, serviceBaseURL(r)+spec+infoJSONSuffix, http.StatusSeeOther)
+			return
+		}
+		if strings.HasSuffix(spec, infoJSONSuffix) {
+			s.handleInfo(w, r, version)
+			return
+		}
+		s.handleImage(w, r, version)
+	}
+}
+
+func (s *Server) handleInfo(w http.ResponseWriter, r *http.Request, version iiif.APIVersion) {
+	identifier, err := iiif.ParseInfoSpec(chi.URLParam(r, "*"))
+	if err != nil {
+		returnError(w, err)
+		return
+	}
+
+	size, err := s.Processor.Dimensions(r.Context(), identifier, s.ResourceResolver)
+	if err != nil {
+		returnError(w, err)
+		return
+	}
+
+	id := requestBaseURL(r) + strings.TrimSuffix(r.URL.EscapedPath(), infoJSONSuffix)
+	var info interface{}
+	var context string
+	switch version {
+	case iiif.APIVersion3:
+		info, context = iiif.NewImageInfo3(id, size, s.Tiling), iiif.ContextURI3
+	default:
+		info, context = iiif.NewImageInfo(id, size, s.Tiling), iiif.ContextURI
+	}
+	body, err := json.Marshal(info)
+	if err != nil {
+		returnError(w, err)
 		return
 	}
 
+	// The spec requires the JSON-LD media type only if the client asks for it.
+	contentType := "application/json"
+	if strings.Contains(r.Header.Get("Accept"), "application/ld+json") {
+		contentType = fmt.Sprintf(`application/ld+json;profile="%s"`, context)
+	}
+	w.Header().Set("Content-type", contentType)
+	w.Header().Set("Cache-Control", s.cacheControlHeader)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(body)
+}
+
+func (s *Server) handleImage(w http.ResponseWriter, r *http.Request, version iiif.APIVersion) {
 	spec := chi.URLParam(r, "*")
 	if r.URL.RawQuery != "" {
 		spec = spec + "?" + r.URL.RawQuery
 	}
 
-	req, err := iiif.ParseSpec(spec)
+	req, err := iiif.ParseVersionedSpec(version, spec)
 	if err != nil {
 		returnError(w, err)
 		return
 	}
 
-	etag := buildETagFromRequest(req)
+	// Clients can only have the ETag of a response they were given, so
+	// there's no need to fetch the source to check for a redirect first
+	etag := buildETagFromRequest(req, version)
 	if match := r.Header.Get("If-None-Match"); match != "" {
 		if strings.Contains(match, etag) {
 			w.WriteHeader(http.StatusNotModified)
@@ -87,22 +207,250 @@ func (s *Server) handleImage(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	buf := bytes.NewBuffer(make([]byte, 0, 1024*50))
+	// Orientation and trimming change the full image size in ways that
+	// can't be determined without decoding it
+	redirect := s.CanonicalRedirectStatus != 0 && !req.AutoOrient && !req.TrimBorder
+
+	if s.DerivativeCache != nil {
+		if d, ok := s.DerivativeCache.Get(etag); ok {
+			if redirect && s.redirectToCanonical(w, r, req, version, spec, d.FullSize, d) {
+				return
+			}
+			w.Header().Set(HTTPHeaderCache, "hit")
+			s.writeImage(w, r, req, version, etag, d)
+			return
+		}
+	}
+
+	if s.DerivativeCache != nil {
+		w.Header().Set(HTTPHeaderCache, "miss")
+	}
 
-	var result iiif.Result
-	if err := s.Processor.Process(*req, s.ResourceResolver, buf, &result); err != nil {
+	// Otherwise the full size is only known once the image is rendered, so
+	// redirects are decided from the render, rather than fetching the
+	// source once more to find out beforehand
+	if s.StreamThreshold > 0 {
+		s.streamImage(w, r, req, version, spec, etag, redirect)
+		return
+	}
+
+	// Identical requests that arrive together share a single render
+	d, err := s.renders.do(r.Context(), etag, func(ctx context.Context) (*derivatives.Derivative, error) {
+		release, err := s.admission.acquire(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+
+		buf := bytes.NewBuffer(make([]byte, 0, 1024*50))
+
+		var result iiif.Result
+		if err := s.Processor.Process(ctx, *req, s.ResourceResolver, buf, &result); err != nil {
+			return nil, err
+		}
+
+		d := &derivatives.Derivative{
+			ContentType: result.ContentType,
+			FullSize:    result.FullSize,
+			Body:        buf.Bytes(),
+		}
+		if s.DerivativeCache != nil {
+			s.DerivativeCache.Put(etag, d)
+		}
+		return d, nil
+	})
+	if err != nil {
 		returnError(w, err)
 		return
 	}
+	if redirect && s.redirectToCanonical(w, r, req, version, spec, d.FullSize, d) {
+		return
+	}
+	s.writeImage(w, r, req, version, etag, d)
+}
 
-	w.Header().Set("Content-type", result.ContentType)
+// notCanonical is the error with which a streamed render stops before it
+// starts streaming, when the request turns out to need redirecting to its
+// canonical form.
+type notCanonical struct {
+	fullSize image.Point
+}
+
+// Error implements interface "error".
+func (notCanonical) Error() string {
+	return "not in canonical form"
+}
+
+// canonical returns the canonical form of a request for an image of the
+// given size, and whether the request is already in that form.
+func canonical(
+	req *iiif.Request,
+	version iiif.APIVersion,
+	spec string,
+	size image.Point) (iiif.Request, bool, error) {
+	canonical, err := req.Canonical(version, size)
+	if err != nil {
+		return iiif.Request{}, false, err
+	}
+	return canonical, canonical.Path(version) == spec, nil
+}
+
+// redirectToCanonical redirects to the canonical form of a request for an
+// image of the given size, unless it is already in that form. It returns
+// whether it responded. If d is not nil, it is the image rendered for the
+// request, which is stored in the derivative cache for the canonical form
+// too, so that following the redirect doesn't render it again.
+func (s *Server) redirectToCanonical(
+	w http.ResponseWriter,
+	r *http.Request,
+	req *iiif.Request,
+	version iiif.APIVersion,
+	spec string,
+	size image.Point,
+	d *derivatives.Derivative) bool {
+	canonical, ok, err := canonical(req, version, spec, size)
+	if err != nil {
+		returnError(w, err)
+		return true
+	}
+	if ok {
+		return false
+	}
+	if d != nil && s.DerivativeCache != nil {
+		s.DerivativeCache.Put(buildETagFromRequest(&canonical, version), d)
+	}
+	http.Redirect(w, r, serviceBaseURL(r)+canonical.Path(version), s.CanonicalRedirectStatus)
+	return true
+}
+
+// streamImage renders an image straight to the client. Output is buffered
+// until it grows larger than StreamThreshold, so that small images get a
+// Content-Length, and errors until then get an error response. Errors
+// after the response has started abort the connection, so that the client
+// doesn't mistake a truncated image for a complete one. Identical requests
+// share the render until it starts streaming. If redirect is set, requests
+// not in canonical form are redirected instead, which is decided before
+// streaming starts.
+func (s *Server) streamImage(
+	w http.ResponseWriter,
+	r *http.Request,
+	req *iiif.Request,
+	version iiif.APIVersion,
+	spec string,
+	etag string,
+	redirect bool) {
+	var streamed bool
+	d, err := s.renders.doStreaming(r.Context(), etag, func(ctx context.Context, detach func()) (*derivatives.Derivative, error) {
+		release, err := s.admission.acquire(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+
+		// Process fills in the result before it starts encoding
+		var result iiif.Result
+		var redirectErr error
+		sw := &streamWriter{
+			w:         w,
+			threshold: s.StreamThreshold,
+			start: func() error {
+				if redirect {
+					if _, ok, _ := canonical(req, version, spec, result.FullSize); !ok {
+						redirectErr = notCanonical{fullSize: result.FullSize}
+						return redirectErr
+					}
+				}
+				detach()
+				s.setImageHeaders(w, r, req, version, etag, result.ContentType, result.FullSize)
+				return nil
+			},
+		}
+		err = s.Processor.Process(ctx, *req, s.ResourceResolver, sw, &result)
+		streamed = sw.streaming
+		if redirectErr != nil {
+			// The encoder may have wrapped it
+			return nil, redirectErr
+		}
+		if err != nil || streamed {
+			return nil, err
+		}
+
+		d := &derivatives.Derivative{
+			ContentType: result.ContentType,
+			FullSize:    result.FullSize,
+			Body:        sw.buf.Bytes(),
+		}
+		if s.DerivativeCache != nil {
+			s.DerivativeCache.Put(etag, d)
+		}
+		return d, nil
+	})
+	if streamed {
+		if err != nil {
+			if r.Context().Err() == nil {
+				log.Printf("Error while streaming %s: %s", req, err)
+			}
+			panic(http.ErrAbortHandler)
+		}
+		return
+	}
+	if e, ok := err.(notCanonical); ok {
+		s.redirectToCanonical(w, r, req, version, spec, e.fullSize, nil)
+		return
+	}
+	if err != nil {
+		returnError(w, err)
+		return
+	}
+	if redirect && s.redirectToCanonical(w, r, req, version, spec, d.FullSize, d) {
+		return
+	}
+	s.writeImage(w, r, req, version, etag, d)
+}
+
+// writeImage responds with a rendered image.
+func (s *Server) writeImage(
+	w http.ResponseWriter,
+	r *http.Request,
+	req *iiif.Request,
+	version iiif.APIVersion,
+	etag string,
+	d *derivatives.Derivative) {
+	s.setImageHeaders(w, r, req, version, etag, d.ContentType, d.FullSize)
+	w.Header().Set("Content-Length", strconv.Itoa(len(d.Body)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(d.Body)
+}
+
+// setImageHeaders sets the headers of a response with a rendered image.
+func (s *Server) setImageHeaders(
+	w http.ResponseWriter,
+	r *http.Request,
+	req *iiif.Request,
+	version iiif.APIVersion,
+	etag string,
+	contentType string,
+	fullSize image.Point) {
+	if canonical, err := req.Canonical(version, fullSize); err == nil {
+		w.Header().Add("Link", fmt.Sprintf(`<%s>;rel="canonical"`,
+			serviceBaseURL(r)+canonical.Path(version)))
+	}
+	w.Header().Add("Link", fmt.Sprintf(`<%s>;rel="profile"`, complianceLevelURIs[version]))
+	w.Header().Set("Content-type", contentType)
 	w.Header().Set("ETag", etag)
 	w.Header().Set("Cache-Control", s.cacheControlHeader)
-	w.WriteHeader(http.StatusOK)
-	io.Copy(w, buf)
 }
 
 func returnError(w http.ResponseWriter, err error) {
+	switch err {
+	case context.DeadlineExceeded:
+		writeError(w, http.StatusGatewayTimeout, "timed out")
+		return
+	case context.Canceled:
+		// The client has gone away, so there's no one to respond to
+		return
+	}
+
 	switch e := err.(type) {
 	case net.Error:
 		if e.Timeout() {
@@ -112,9 +460,37 @@ func returnError(w http.ResponseWriter, err error) {
 	case resources.InvalidIdentifier:
 		writeError(w, http.StatusBadRequest, "invalid identifier %q", e.Identifier)
 		return
+	case resources.NotFound:
+		writeError(w, http.StatusNotFound, "not found %q", e.Identifier)
+		return
+	case resources.Forbidden:
+		writeError(w, http.StatusForbidden, "forbidden %q", e.Identifier)
+		return
+	case resources.TooLarge:
+		writeError(w, http.StatusRequestEntityTooLarge, "too large %q", e.Identifier)
+		return
+	case resources.Unavailable:
+		log.Printf("Upstream error: %s", err)
+		switch {
+		case e.Timeout:
+			writeError(w, http.StatusGatewayTimeout, "upstream timed out")
+		case e.StatusCode == http.StatusServiceUnavailable:
+			writeError(w, http.StatusServiceUnavailable, "upstream unavailable")
+		default:
+			writeError(w, http.StatusBadGateway, "upstream error")
+		}
+		return
+	case overloadedError:
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(e.retryAfter.Seconds()))))
+		writeError(w, http.StatusServiceUnavailable, "too busy")
+		return
 	case iiif.InvalidSpec:
 		writeError(w, http.StatusBadRequest, "invalid request: %s", e)
 		return
+	case iiif.ImageTooLarge:
+		writeError(w, http.StatusRequestEntityTooLarge, "too large %q: %dx%d pixels",
+			e.Identifier, e.Size.X, e.Size.Y)
+		return
 	}
 
 	log.Printf("Error: %s", err)
@@ -127,11 +503,43 @@ func writeError(w http.ResponseWriter, statusCode int, format string, args ...in
 	w.Write([]byte(fmt.Sprintf(format, args...)))
 }
 
-func buildETagFromRequest(req *iiif.Request) string {
+// requestBaseURL returns the scheme and host that the client used to reach
+// us, taking proxies into account.
+func requestBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
+}
+
+// serviceBaseURL returns the absolute URL of the image service that the
+// request was made to, ending with a slash.
+func serviceBaseURL(r *http.Request) string {
+	return requestBaseURL(r) + strings.TrimSuffix(r.URL.EscapedPath(), chi.URLParam(r, "*"))
+}
+
+func buildETagFromRequest(req *iiif.Request, version iiif.APIVersion) string {
 	hasher := sha256.New()
-	hasher.Write([]byte(req.String()))
+	hasher.Write([]byte(req.VersionedString(version)))
+	// The same string can mean different things in different versions,
+	// such as whether a size may upscale. Version 2 ETags are left as they
+	// were, so that they remain valid.
+	if version != iiif.APIVersion2 {
+		hasher.Write([]byte(fmt.Sprintf("v%d", version+2)))
+	}
 	hasher.Write([]byte(cacheVersion))
 	return hex.EncodeToString(hasher.Sum(nil))
 }
 
 var cacheVersion = "1" // Increase to bust cache
+
+const infoJSONSuffix = "/info.json"
+
+var complianceLevelURIs = map[iiif.APIVersion]string{
+	iiif.APIVersion2: iiif.ComplianceLevelURI,
+	iiif.APIVersion3: iiif.ComplianceLevelURI3,
+}
@@ -1,10 +1,18 @@
 package server_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -12,6 +20,7 @@ import (
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 
+	"github.com/t11e/picaxe/derivatives"
 	"github.com/t11e/picaxe/iiif"
 	iiif_mocks "github.com/t11e/picaxe/iiif/mocks"
 	"github.com/t11e/picaxe/resources"
@@ -74,7 +83,7 @@ func (err timeoutErr) Temporary() bool { return true }
 func TestServer_timeouts(t *testing.T) {
 	processor := &iiif_mocks.Processor{}
 	processor.On("Process",
-		mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(timeoutErr{})
+		mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(timeoutErr{})
 
 	ts := newTestServer(server.ServerOptions{
 		ResourceResolver: &resources_mocks.Resolver{},
@@ -96,11 +105,46 @@ func TestServer_timeouts(t *testing.T) {
 	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
 }
 
+func TestServer_resourceErrors(t *testing.T) {
+	for _, test := range []struct {
+		err    error
+		status int
+		body   string
+	}{
+		{resources.NotFound{Identifier: "foo"}, http.StatusNotFound, `not found "foo"`},
+		{resources.Forbidden{Identifier: "foo"}, http.StatusForbidden, `forbidden "foo"`},
+		{resources.TooLarge{Identifier: "foo"}, http.StatusRequestEntityTooLarge, `too large "foo"`},
+		{resources.Unavailable{Identifier: "foo", StatusCode: 500}, http.StatusBadGateway, "upstream error"},
+		{resources.Unavailable{Identifier: "foo"}, http.StatusBadGateway, "upstream error"},
+		{resources.Unavailable{Identifier: "foo", StatusCode: 503}, http.StatusServiceUnavailable, "upstream unavailable"},
+		{resources.Unavailable{Identifier: "foo", Timeout: true}, http.StatusGatewayTimeout, "upstream timed out"},
+		{context.DeadlineExceeded, http.StatusGatewayTimeout, "timed out"},
+		{iiif.ImageTooLarge{Identifier: "foo", Size: image.Pt(50000, 50000)},
+			http.StatusRequestEntityTooLarge, `too large "foo": 50000x50000 pixels`},
+	} {
+		t.Run(test.err.Error(), func(t *testing.T) {
+			processor := &iiif_mocks.Processor{}
+			processor.On("Process",
+				mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(test.err)
+
+			ts := newTestServer(server.ServerOptions{
+				ResourceResolver: &resources_mocks.Resolver{},
+				Processor:        processor,
+			})
+			defer ts.Close()
+
+			resp, body := doRequest(t, ts, "/api/picaxe/v1/iiif/foo/full/max/0/default.png")
+			assert.Equal(t, test.status, resp.StatusCode)
+			assert.Equal(t, test.body, body)
+		})
+	}
+}
+
 func TestServer_iiifHandler(t *testing.T) {
 	resolver := &resources_mocks.Resolver{}
 
 	processor := &iiif_mocks.Processor{}
-	processor.On("Process", iiif.Request{
+	processor.On("Process", mock.Anything, iiif.Request{
 		Identifier: "http://i.imgur.com/J1XaOIa.jpg",
 		Region: iiif.Region{
 			Kind: iiif.RegionKindFull,
@@ -111,10 +155,10 @@ func TestServer_iiifHandler(t *testing.T) {
 		Format: iiif.FormatPNG,
 	}, resolver, mock.Anything, mock.Anything).Run(
 		func(args mock.Arguments) {
-			w := args.Get(2).(io.Writer)
+			w := args.Get(3).(io.Writer)
 			w.Write([]byte("result")) // Dummy image data
 
-			result := args.Get(3).(*iiif.Result)
+			result := args.Get(4).(*iiif.Result)
 			assert.NotNil(t, result)
 			result.ContentType = "image/smurf"
 		}).Return(nil)
@@ -137,6 +181,624 @@ func TestServer_iiifHandler(t *testing.T) {
 	processor.AssertNumberOfCalls(t, "Process", 1)
 }
 
+func TestServer_iiifHandler_derivativeCache(t *testing.T) {
+	resolver := &resources_mocks.Resolver{}
+
+	processor := &iiif_mocks.Processor{}
+	processor.On("Process", mock.Anything, mock.Anything, resolver, mock.Anything, mock.Anything).Run(
+		func(args mock.Arguments) {
+			args.Get(3).(io.Writer).Write([]byte("result"))
+			result := args.Get(4).(*iiif.Result)
+			result.ContentType = "image/smurf"
+			result.FullSize = image.Pt(640, 480)
+		}).Return(nil)
+
+	ts := newTestServer(server.ServerOptions{
+		ResourceResolver: resolver,
+		Processor:        processor,
+		DerivativeCache:  derivatives.NewMemoryCache(1024),
+	})
+	defer ts.Close()
+
+	for _, cache := range []string{"miss", "hit", "hit"} {
+		resp, body := doRequest(t, ts, "/api/picaxe/v1/iiif/foo/full/max/0/default.png")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "result", body)
+		assert.Equal(t, cache, resp.Header.Get(server.HTTPHeaderCache))
+		assert.Equal(t, "image/smurf", resp.Header.Get("Content-Type"))
+		assert.Contains(t, resp.Header["Link"], fmt.Sprintf(`<%s/api/picaxe/v1/iiif/foo/full/full/0/default.png>;rel="canonical"`, ts.URL))
+	}
+	processor.AssertNumberOfCalls(t, "Process", 1)
+
+	_, body := doRequest(t, ts, "/api/picaxe/v1/iiif/foo/full/max/0/default.jpg")
+	assert.Equal(t, "result", body)
+	processor.AssertNumberOfCalls(t, "Process", 2)
+}
+
+func TestServer_iiifHandler_streaming(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		chunks        []string
+		err           error
+		status        int
+		body          string
+		contentLength int64
+		aborted       bool
+	}{
+		{"buffered", []string{"smal", "l"}, nil, http.StatusOK, "small", 5, false},
+		{"streamed", []string{"not so ", "small", "!"}, nil, http.StatusOK, "not so small!", -1, false},
+		{"error while buffered", []string{"small"}, errors.New("failed"),
+			http.StatusInternalServerError, "internal error", 14, false},
+		{"error while streamed", []string{"not so ", "small"}, errors.New("failed"), http.StatusOK, "", -1, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			processor := &iiif_mocks.Processor{}
+			processor.On("Process", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Run(
+				func(args mock.Arguments) {
+					result := args.Get(4).(*iiif.Result)
+					result.ContentType = "image/smurf"
+					result.FullSize = image.Pt(640, 480)
+					for _, chunk := range test.chunks {
+						args.Get(3).(io.Writer).Write([]byte(chunk))
+					}
+				}).Return(test.err)
+
+			ts := newTestServer(server.ServerOptions{
+				ResourceResolver: &resources_mocks.Resolver{},
+				Processor:        processor,
+				StreamThreshold:  8,
+			})
+			defer ts.Close()
+
+			resp, err := http.Get(ts.URL + "/api/picaxe/v1/iiif/foo/full/max/0/default.png")
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, test.status, resp.StatusCode)
+			assert.Equal(t, test.contentLength, resp.ContentLength)
+
+			body, err := ioutil.ReadAll(resp.Body)
+			if test.aborted {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.body, string(body))
+			if test.status == http.StatusOK {
+				assert.Equal(t, "image/smurf", resp.Header.Get("Content-Type"))
+				assert.Contains(t, resp.Header["Link"], fmt.Sprintf(
+					`<%s/api/picaxe/v1/iiif/foo/full/full/0/default.png>;rel="canonical"`, ts.URL))
+			}
+		})
+	}
+}
+
+func TestServer_iiifHandler_coalescing(t *testing.T) {
+	resolver := &resources_mocks.Resolver{}
+
+	started, release := make(chan struct{}), make(chan struct{})
+	var canceled int32
+	processor := &iiif_mocks.Processor{}
+	processor.On("Process", mock.Anything, mock.Anything, resolver, mock.Anything, mock.Anything).Run(
+		func(args mock.Arguments) {
+			close(started)
+			<-release
+			if args.Get(0).(context.Context).Err() != nil {
+				atomic.StoreInt32(&canceled, 1)
+			}
+			args.Get(3).(io.Writer).Write([]byte("result"))
+			args.Get(4).(*iiif.Result).ContentType = "image/png"
+		}).Return(nil)
+
+	ts := newTestServer(server.ServerOptions{
+		ResourceResolver: resolver,
+		Processor:        processor,
+	})
+	defer ts.Close()
+	path := "/api/picaxe/v1/iiif/foo/full/max/0/default.png"
+
+	// The request that starts the render gives up before it is done
+	ctx, cancel := context.WithCancel(context.Background())
+	leaderErr := make(chan error)
+	go func() {
+		req, err := http.NewRequest("GET", ts.URL+path, nil)
+		require.NoError(t, err)
+		_, err = http.DefaultClient.Do(req.WithContext(ctx))
+		leaderErr <- err
+	}()
+	<-started
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, body := doRequest(t, ts, path)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, "result", body)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	assert.Error(t, <-leaderErr)
+	close(release)
+	wg.Wait()
+
+	processor.AssertNumberOfCalls(t, "Process", 1)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&canceled))
+}
+
+func TestServer_iiifHandler_coalescingVersions(t *testing.T) {
+	resolver := &resources_mocks.Resolver{}
+
+	paths := []string{
+		"/api/picaxe/v1/iiif/foo/full/max/0/default.png",
+		"/api/picaxe/v3/iiif/foo/full/max/0/default.png",
+		"/api/picaxe/v3/iiif/foo/full/%5Emax/0/default.png",
+		"/api/picaxe/v1/iiif/foo/full/200,/90/default.png",
+		"/api/picaxe/v3/iiif/foo/full/200,/90/default.png",
+	}
+	started, release := make(chan struct{}, len(paths)), make(chan struct{})
+	processor := &iiif_mocks.Processor{}
+	processor.On("Process", mock.Anything, mock.Anything, resolver, mock.Anything, mock.Anything).Run(
+		func(args mock.Arguments) {
+			started <- struct{}{}
+			<-release
+			req := args.Get(1).(iiif.Request)
+			fmt.Fprintf(args.Get(3).(io.Writer), "%d %s", req.Size.Upscaling, req.VersionedString(iiif.APIVersion3))
+			args.Get(4).(*iiif.Result).ContentType = "image/png"
+		}).Return(nil)
+
+	ts := newTestServer(server.ServerOptions{
+		ResourceResolver: resolver,
+		Processor:        processor,
+	})
+	defer ts.Close()
+
+	bodies := make([]string, len(paths))
+	var wg sync.WaitGroup
+	for i, path := range paths {
+		wg.Add(1)
+		go func(i int, path string) {
+			defer wg.Done()
+			resp, body := doRequest(t, ts, path)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			bodies[i] = body
+		}(i, path)
+	}
+	// Every request must be rendered separately, at the same time
+	timeout := time.After(5 * time.Second)
+wait:
+	for range paths {
+		select {
+		case <-started:
+		case <-timeout:
+			t.Error("requests were coalesced")
+			break wait
+		}
+	}
+	close(release)
+	wg.Wait()
+
+	processor.AssertNumberOfCalls(t, "Process", len(paths))
+	assert.Equal(t, []string{
+		"0 foo/full/max/0/default.png",
+		"1 foo/full/max/0/default.png",
+		"2 foo/full/^max/0/default.png",
+		"0 foo/full/200,/90/default.png",
+		"1 foo/full/200,/90/default.png",
+	}, bodies)
+}
+
+func TestServer_iiifHandler_streamingCoalescing(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		body  string
+		calls int
+	}{
+		// Identical requests share a render until it starts streaming
+		{"buffered", "small", 1},
+		{"streamed", "not so small!", 4},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			resolver := &resources_mocks.Resolver{}
+
+			started, release := make(chan struct{}), make(chan struct{})
+			var once sync.Once
+			processor := &iiif_mocks.Processor{}
+			processor.On("Process", mock.Anything, mock.Anything, resolver, mock.Anything, mock.Anything).Run(
+				func(args mock.Arguments) {
+					args.Get(4).(*iiif.Result).ContentType = "image/png"
+					once.Do(func() { close(started) })
+					<-release
+					args.Get(3).(io.Writer).Write([]byte(test.body))
+				}).Return(nil)
+
+			ts := newTestServer(server.ServerOptions{
+				ResourceResolver: resolver,
+				Processor:        processor,
+				StreamThreshold:  8,
+			})
+			defer ts.Close()
+			path := "/api/picaxe/v1/iiif/foo/full/max/0/default.png"
+
+			var wg sync.WaitGroup
+			request := func() {
+				defer wg.Done()
+				resp, body := doRequest(t, ts, path)
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+				assert.Equal(t, test.body, body)
+			}
+			wg.Add(1)
+			go request()
+			<-started
+			for i := 0; i < 3; i++ {
+				wg.Add(1)
+				go request()
+			}
+			time.Sleep(50 * time.Millisecond)
+			close(release)
+			wg.Wait()
+
+			processor.AssertNumberOfCalls(t, "Process", test.calls)
+		})
+	}
+}
+
+func TestServer_iiifHandler_admission(t *testing.T) {
+	resolver := &resources_mocks.Resolver{}
+
+	started, release := make(chan struct{}), make(chan struct{})
+	processor := &iiif_mocks.Processor{}
+	processor.On("Process", mock.Anything, mock.Anything, resolver, mock.Anything, mock.Anything).Run(
+		func(args mock.Arguments) {
+			close(started)
+			<-release
+			args.Get(3).(io.Writer).Write([]byte("result"))
+			args.Get(4).(*iiif.Result).ContentType = "image/png"
+		}).Return(nil)
+
+	ts := newTestServer(server.ServerOptions{
+		ResourceResolver:       resolver,
+		Processor:              processor,
+		MaxConcurrentProcesses: 1,
+		MaxQueuedProcesses:     1,
+		MaxQueueWait:           200 * time.Millisecond,
+	})
+	defer ts.Close()
+
+	stats := func() map[string]float64 {
+		_, body := doRequest(t, ts, "/api/picaxe/stats")
+		var stats map[string]float64
+		require.NoError(t, json.Unmarshal([]byte(body), &stats))
+		return stats
+	}
+
+	done := make(chan int)
+	go func() {
+		resp, _ := doRequest(t, ts, "/api/picaxe/v1/iiif/foo/full/max/0/default.png")
+		done <- resp.StatusCode
+	}()
+	<-started
+	go func() {
+		resp, _ := doRequest(t, ts, "/api/picaxe/v1/iiif/bar/full/max/0/default.png")
+		done <- resp.StatusCode
+	}()
+	for stats()["queued"] == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, map[string]float64{
+		"processing":       1,
+		"queued":           1,
+		"admitted":         1,
+		"rejected":         0,
+		"totalWaitSeconds": 0,
+	}, stats())
+
+	// The queue is full
+	resp, body := doRequest(t, ts, "/api/picaxe/v1/iiif/baz/full/max/0/default.png")
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+	assert.Equal(t, "too busy", body)
+
+	// The queued request waits too long
+	assert.Equal(t, http.StatusServiceUnavailable, <-done)
+
+	close(release)
+	assert.Equal(t, http.StatusOK, <-done)
+	processor.AssertNumberOfCalls(t, "Process", 1)
+	s := stats()
+	assert.Equal(t, float64(0), s["processing"])
+	assert.Equal(t, float64(0), s["queued"])
+	assert.Equal(t, float64(2), s["rejected"])
+}
+
+func TestServer_infoHandler(t *testing.T) {
+	resolver := &resources_mocks.Resolver{}
+
+	processor := &iiif_mocks.Processor{}
+	processor.On("Dimensions", mock.Anything, "http://i.imgur.com/J1XaOIa.jpg", resolver).Return(image.Pt(640, 480), nil)
+
+	ts := newTestServer(server.ServerOptions{
+		ResourceResolver: resolver,
+		Processor:        processor,
+		MaxAge:           time.Hour,
+	})
+	defer ts.Close()
+
+	resp, body := doRequest(t, ts,
+		"/api/picaxe/v1/iiif/http%3A%2F%2Fi.imgur.com%2FJ1XaOIa.jpg/info.json")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	require.Equal(t, "public,s-maxage=3600", resp.Header.Get("Cache-Control"))
+
+	var info map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(body), &info))
+	assert.Equal(t, "http://iiif.io/api/image/2/context.json", info["@context"])
+	assert.Equal(t, ts.URL+"/api/picaxe/v1/iiif/http%3A%2F%2Fi.imgur.com%2FJ1XaOIa.jpg", info["@id"])
+	assert.Equal(t, "http://iiif.io/api/image", info["protocol"])
+	assert.Equal(t, float64(640), info["width"])
+	assert.Equal(t, float64(480), info["height"])
+
+	processor.AssertNumberOfCalls(t, "Dimensions", 1)
+}
+
+func TestServer_infoHandler_jsonLD(t *testing.T) {
+	resolver := &resources_mocks.Resolver{}
+
+	processor := &iiif_mocks.Processor{}
+	processor.On("Dimensions", mock.Anything, "foo", resolver).Return(image.Pt(640, 480), nil)
+
+	ts := newTestServer(server.ServerOptions{
+		ResourceResolver: resolver,
+		Processor:        processor,
+	})
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL+"/api/picaxe/v1/iiif/foo/info.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/ld+json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, `application/ld+json;profile="http://iiif.io/api/image/2/context.json"`,
+		resp.Header.Get("Content-Type"))
+}
+
+func TestServer_iiifHandler_v3(t *testing.T) {
+	resolver := &resources_mocks.Resolver{}
+
+	processor := &iiif_mocks.Processor{}
+	processor.On("Process", mock.Anything, iiif.Request{
+		Identifier: "foo",
+		Region:     iiif.Region{Kind: iiif.RegionKindFull},
+		Size:       iiif.Size{Kind: iiif.SizeKindMax, Upscaling: iiif.UpscalingRequested},
+		Format:     iiif.FormatPNG,
+	}, resolver, mock.Anything, mock.Anything).Run(
+		func(args mock.Arguments) {
+			args.Get(4).(*iiif.Result).ContentType = "image/png"
+		}).Return(nil)
+
+	ts := newTestServer(server.ServerOptions{
+		ResourceResolver: resolver,
+		Processor:        processor,
+	})
+	defer ts.Close()
+
+	resp, _ := doRequest(t, ts, "/api/picaxe/v3/iiif/foo/full/^max/0/default.png")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "image/png", resp.Header.Get("Content-Type"))
+
+	resp, body := doRequest(t, ts, "/api/picaxe/v3/iiif/foo/full/full/0/default.png")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "invalid request: Not a valid size: full", body)
+
+	processor.AssertNumberOfCalls(t, "Process", 1)
+}
+
+func TestServer_infoHandler_v3(t *testing.T) {
+	resolver := &resources_mocks.Resolver{}
+
+	processor := &iiif_mocks.Processor{}
+	processor.On("Dimensions", mock.Anything, "foo", resolver).Return(image.Pt(640, 480), nil)
+
+	ts := newTestServer(server.ServerOptions{
+		ResourceResolver: resolver,
+		Processor:        processor,
+	})
+	defer ts.Close()
+
+	resp, body := doRequest(t, ts, "/api/picaxe/v3/iiif/foo/info.json")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var info map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(body), &info))
+	assert.Equal(t, "http://iiif.io/api/image/3/context.json", info["@context"])
+	assert.Equal(t, ts.URL+"/api/picaxe/v3/iiif/foo", info["id"])
+	assert.Equal(t, "ImageService3", info["type"])
+	assert.Equal(t, "level1", info["profile"])
+	assert.Equal(t, float64(640), info["width"])
+	assert.Equal(t, float64(480), info["height"])
+}
+
+func TestServer_iiifHandler_links(t *testing.T) {
+	resolver := &resources_mocks.Resolver{}
+
+	processor := &iiif_mocks.Processor{}
+	processor.On("Process", mock.Anything, mock.Anything, resolver, mock.Anything, mock.Anything).Run(
+		func(args mock.Arguments) {
+			result := args.Get(4).(*iiif.Result)
+			result.ContentType = "image/png"
+			result.FullSize = image.Pt(640, 480)
+		}).Return(nil)
+
+	ts := newTestServer(server.ServerOptions{
+		ResourceResolver: resolver,
+		Processor:        processor,
+	})
+	defer ts.Close()
+
+	resp, _ := doRequest(t, ts, "/api/picaxe/v1/iiif/foo/full/pct:50/0/default.png")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []string{
+		`<` + ts.URL + `/api/picaxe/v1/iiif/foo/full/320,/0/default.png>;rel="canonical"`,
+		`<http://iiif.io/api/image/2/level1.json>;rel="profile"`,
+	}, resp.Header["Link"])
+}
+
+func TestServer_iiifHandler_canonicalRedirect(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		opts          server.ServerOptions
+		expectRenders int
+	}{
+		// The image rendered for the redirected request is cached for the
+		// canonical one
+		{"cached", server.ServerOptions{DerivativeCache: derivatives.NewMemoryCache(1024)}, 1},
+		{"uncached", server.ServerOptions{}, 2},
+		// The redirect is decided before the image starts streaming
+		{"streamed", server.ServerOptions{StreamThreshold: 10}, 2},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			resolver := &resources_mocks.Resolver{}
+
+			processor := &iiif_mocks.Processor{}
+			processor.On("Process", mock.Anything, mock.Anything, resolver, mock.Anything, mock.Anything).Return(
+				func(_ context.Context, _ iiif.Request, _ resources.Resolver, w io.Writer, result *iiif.Result) error {
+					result.ContentType = "image/png"
+					result.FullSize = image.Pt(640, 480)
+					_, err := w.Write(bytes.Repeat([]byte("x"), 100))
+					return err
+				})
+
+			opts := test.opts
+			opts.ResourceResolver = resolver
+			opts.Processor = processor
+			opts.CanonicalRedirectStatus = http.StatusMovedPermanently
+			ts := newTestServer(opts)
+			defer ts.Close()
+
+			client := &http.Client{
+				CheckRedirect: func(*http.Request, []*http.Request) error {
+					return http.ErrUseLastResponse
+				},
+			}
+
+			resp, err := client.Get(ts.URL + "/api/picaxe/v1/iiif/foo/full/pct:50/0/default.png")
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusMovedPermanently, resp.StatusCode)
+			assert.Equal(t, ts.URL+"/api/picaxe/v1/iiif/foo/full/320,/0/default.png", resp.Header.Get("Location"))
+
+			resp, err = client.Get(ts.URL + "/api/picaxe/v1/iiif/foo/full/320,/0/default.png")
+			require.NoError(t, err)
+			body, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Len(t, body, 100)
+			processor.AssertNumberOfCalls(t, "Process", test.expectRenders)
+
+			// Unmodified images don't need the source
+			req, err := http.NewRequest("GET", ts.URL+"/api/picaxe/v1/iiif/foo/full/320,/0/default.png", nil)
+			require.NoError(t, err)
+			req.Header.Set("If-None-Match", resp.Header.Get("ETag"))
+			resp, err = client.Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+
+			processor.AssertNumberOfCalls(t, "Process", test.expectRenders)
+			processor.AssertNumberOfCalls(t, "Dimensions", 0)
+		})
+	}
+}
+
+func TestServer_baseURIRedirect(t *testing.T) {
+	ts := newTestServer(server.ServerOptions{
+		ResourceResolver: &resources_mocks.Resolver{},
+		Processor:        &iiif_mocks.Processor{},
+	})
+	defer ts.Close()
+
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	for _, prefix := range []string{"/api/picaxe/v1/iiif/", "/api/picaxe/v3/iiif/"} {
+		resp, err := client.Get(ts.URL + prefix + "http%3A%2F%2Fi.imgur.com%2FJ1XaOIa.jpg")
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusSeeOther, resp.StatusCode)
+		assert.Equal(t, ts.URL+prefix+"http%3A%2F%2Fi.imgur.com%2FJ1XaOIa.jpg/info.json",
+			resp.Header.Get("Location"))
+	}
+}
+
+func TestServer_cors(t *testing.T) {
+	resolver := &resources_mocks.Resolver{}
+
+	processor := &iiif_mocks.Processor{}
+	processor.On("Dimensions", mock.Anything, "foo", resolver).Return(image.Pt(640, 480), nil)
+
+	for _, test := range []struct {
+		origins  []string
+		origin   string
+		expected string
+		vary     string
+	}{
+		{nil, "http://example.com", "", ""},
+		{[]string{"http://example.com"}, "http://example.com", "http://example.com", "Origin"},
+		{[]string{"http://example.com"}, "http://example.org", "", "Origin"},
+		{[]string{"http://example.com"}, "", "", "Origin"},
+		{[]string{"*"}, "http://example.org", "*", ""},
+	} {
+		t.Run(fmt.Sprintf("%v/%s", test.origins, test.origin), func(t *testing.T) {
+			ts := newTestServer(server.ServerOptions{
+				ResourceResolver: resolver,
+				Processor:        processor,
+				CORSOrigins:      test.origins,
+			})
+			defer ts.Close()
+
+			req, err := http.NewRequest("GET", ts.URL+"/api/picaxe/v1/iiif/foo/info.json", nil)
+			require.NoError(t, err)
+			req.Header.Set("Origin", test.origin)
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, test.expected, resp.Header.Get("Access-Control-Allow-Origin"))
+			assert.Equal(t, test.vary, resp.Header.Get("Vary"))
+
+			req, err = http.NewRequest("OPTIONS", ts.URL+"/api/picaxe/v1/iiif/foo/info.json", nil)
+			require.NoError(t, err)
+			req.Header.Set("Origin", test.origin)
+			req.Header.Set("Access-Control-Request-Method", "GET")
+			req.Header.Set("Access-Control-Request-Headers", "Accept")
+			resp, err = http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+			if test.expected != "" {
+				assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+				assert.Equal(t, test.expected, resp.Header.Get("Access-Control-Allow-Origin"))
+				assert.Contains(t, resp.Header.Get("Access-Control-Allow-Methods"), "GET")
+				assert.Equal(t, "Accept", resp.Header.Get("Access-Control-Allow-Headers"))
+			} else {
+				assert.Empty(t, resp.Header.Get("Access-Control-Allow-Origin"))
+			}
+		})
+	}
+}
+
 func doRequest(t *testing.T, ts *httptest.Server, path string) (*http.Response, string) {
 	req, err := http.NewRequest("GET", ts.URL+path, nil)
 	if err != nil {
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"runtime/debug"
+)
+
+// streamWriter buffers output until it grows larger than a threshold, and
+// then streams it to the response, starting the response first. Output
+// that never gets that large is left in the buffer. The response is
+// flushed when streaming starts, so that the client gets the headers and
+// the first bytes without waiting for the server's own buffer to fill.
+// Streaming doesn't start if start returns an error, which is returned by
+// Write instead.
+type streamWriter struct {
+	w         http.ResponseWriter
+	threshold int
+	start     func() error
+
+	buf       bytes.Buffer
+	streaming bool
+}
+
+// Write implements interface io.Writer.
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	if sw.streaming {
+		return sw.w.Write(p)
+	}
+	if sw.buf.Len()+len(p) <= sw.threshold {
+		return sw.buf.Write(p)
+	}
+
+	if err := sw.start(); err != nil {
+		return 0, err
+	}
+	sw.streaming = true
+	sw.w.WriteHeader(http.StatusOK)
+	_, err := sw.w.Write(sw.buf.Bytes())
+	sw.buf = bytes.Buffer{}
+	if err != nil {
+		return 0, err
+	}
+	n, err := sw.w.Write(p)
+	if f, ok := sw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
+
+// recoverer is like middleware.Recoverer, responding with status 500 to
+// handlers that panic, except that it lets http.ErrAbortHandler through so
+// that the server aborts the response.
+func recoverer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if p := recover(); p != nil {
+				if p == http.ErrAbortHandler {
+					panic(p)
+				}
+				log.Printf("Panic: %v\n%s", p, debug.Stack())
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
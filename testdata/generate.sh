@@ -18,3 +18,13 @@ for file in hippos.png; do
     -crop 160x120+320+240 +repage \
     $file png:${file%.*}-crop-320,240,480,360.png
 done
+
+# LZW TIFFs written by libtiff, as a single strip, to check the TIFF encoder
+# against
+for file in hippos-crop-50,50,150,150.png; do
+  $convert $file -alpha set -depth 8 -compress none tif:/tmp/rgba.tif
+  tiffcp -c lzw -r 1000 /tmp/rgba.tif ${file%.*}-lzw.tif
+  $convert $file -colorspace gray -depth 8 -compress none tif:/tmp/gray.tif
+  tiffcp -c lzw -r 1000 /tmp/gray.tif ${file%.*}-gray-lzw.tif
+  rm /tmp/rgba.tif /tmp/gray.tif
+done